@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// AccessLogConfig configures logging of served requests, including ones
+// refused by proxy itself
+type AccessLogConfig struct {
+	// ErrorsOnly suppresses logging of requests with status below
+	// MinErrorStatus
+	ErrorsOnly bool
+	// MinErrorStatus is the lowest status considered an error, 400 by
+	// default; i.e. 500 makes only 5xx responses logged
+	MinErrorStatus int `json:",omitempty"`
+}
+
+func (c *AccessLogConfig) validate() error {
+	if c != nil && c.MinErrorStatus != 0 && (c.MinErrorStatus < 100 || c.MinErrorStatus > 999) {
+		return errors.New("AccessLog.MinErrorStatus is invalid")
+	}
+	return nil
+}
+
+func (c *AccessLogConfig) log(t *routeTable, r *http.Request, status int, d time.Duration) {
+	if status == 0 {
+		status = http.StatusOK // written implicitly by net/http
+	}
+	if c.ErrorsOnly {
+		min := c.MinErrorStatus
+		if min == 0 {
+			min = http.StatusBadRequest
+		}
+		if status < min {
+			return
+		}
+	}
+	log.Printf("%s %s %s %q %d %v", r.Host, t.clientIP(r), r.Method, r.RequestURI, status,
+		d.Round(time.Millisecond))
+}
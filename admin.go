@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// newAdminHandler returns handler serving administrative endpoints of rp.
+// Every request must carry "Authorization: Bearer <token>" header.
+//
+//	GET /stats              returns Snapshot
+//	GET /reload             returns ReloadStatus of the last reload
+//	POST /reload            reloads configuration, returning ReloadStatus
+//	GET /limits?host=name   returns Limits of host
+//	POST /limits?host=name  sets non-zero fields of Limits from request body
+//
+// Limits set over admin endpoint are in effect until the next reload.
+func newAdminHandler(rp *RevProxy, rl *reloader, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/limits", func(w http.ResponseWriter, r *http.Request) {
+		b, ok := rp.table.Load().backends[r.URL.Query().Get("host")]
+		if !ok {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var l Limits
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&l); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if l.MaxConns < 0 || l.MaxStreamConns < 0 || (l.MaxStreamConns > 0 && b.stream == nil) {
+				http.Error(w, "invalid limits", http.StatusBadRequest)
+				return
+			}
+			if l.MaxConns > 0 {
+				b.bucket.resize(l.MaxConns)
+			}
+			if l.MaxStreamConns > 0 {
+				b.stream.resize(l.MaxStreamConns)
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, Limits{
+			MaxConns:       b.bucket.cap(),
+			MaxStreamConns: b.stream.cap(),
+		})
+	})
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		var st ReloadStatus
+		switch r.Method {
+		case http.MethodGet:
+			st = rl.status()
+		case http.MethodPost:
+			if st = rl.reload(); st.Error != "" {
+				writeJSON(w, http.StatusUnprocessableEntity, st)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, st)
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, rp.snapshot())
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(v)
+}
+
+// Limits are concurrency limits of a single host. MaxStreamConns can only be
+// changed if host has Streaming configured.
+type Limits struct {
+	MaxConns       int
+	MaxStreamConns int `json:",omitempty"`
+}
+
+// Snapshot is a point-in-time view of proxy state
+type Snapshot struct {
+	Hosts []HostSnapshot
+	// MissingHost is a number of requests rejected for missing Host
+	MissingHost uint64
+	// ConflictingHost is a number of requests rejected for having
+	// several Host values or Host differing from HTTP/2 :authority
+	ConflictingHost uint64
+	// TLSHandshakeErrors counts failed handshakes by cause
+	TLSHandshakeErrors map[string]uint64 `json:",omitempty"`
+	// Listeners describes connection limits of listeners
+	Listeners []ListenerSnapshot `json:",omitempty"`
+}
+
+// ListenerSnapshot describes connection limit of a single listener
+type ListenerSnapshot struct {
+	Name     string
+	Conns    int
+	MaxConns int
+	// AtLimit is true if listener is waiting for connections to be
+	// closed before accepting new ones
+	AtLimit bool
+	// Saturated is a number of times listener had to wait
+	Saturated uint64
+}
+
+// HostSnapshot describes state of a single host. Latencies are in seconds
+// and are approximated by histogram bucket bounds.
+type HostSnapshot struct {
+	Host           string
+	Backend        string
+	Conns          int
+	MaxConns       int
+	StreamConns    int `json:",omitempty"`
+	MaxStreamConns int `json:",omitempty"`
+	Requests       uint64
+	Errors         uint64
+	LatencyP50     float64
+	LatencyP99     float64
+
+	// Truncated is a number of responses whose body couldn't be read
+	// from backend completely
+	Truncated uint64 `json:",omitempty"`
+	// LatencyObjective is route's latency objective, in seconds.
+	// SLORequests is a number of requests checked against an objective,
+	// SLOViolations a number of those that exceeded it, and SLORatio the
+	// fraction of checked requests that met it (nil if there were none).
+	LatencyObjective float64  `json:",omitempty"`
+	SLORequests      uint64   `json:",omitempty"`
+	SLOViolations    uint64   `json:",omitempty"`
+	SLORatio         *float64 `json:",omitempty"`
+	// Concurrency groups requests by number of requests in flight in
+	// the same bucket at the time they were admitted
+	Concurrency []ConcurrencyBand `json:",omitempty"`
+}
+
+// ConcurrencyBand describes requests admitted at concurrency levels up to
+// Max (or above previous band's Max for the last band, which has Max = -1)
+type ConcurrencyBand struct {
+	Max        int
+	Requests   uint64
+	LatencyP50 float64
+	LatencyP99 float64
+}
+
+func (rp *RevProxy) snapshot() Snapshot {
+	out := Snapshot{
+		MissingHost:        rp.missingHost.Load(),
+		ConflictingHost:    rp.conflictingHost.Load(),
+		TLSHandshakeErrors: rp.handshakeErrors.snapshot(),
+	}
+	for _, ln := range rp.listeners {
+		out.Listeners = append(out.Listeners, ListenerSnapshot{
+			Name:      ln.name,
+			Conns:     len(ln.sem),
+			MaxConns:  cap(ln.sem),
+			AtLimit:   ln.atLimit.Load(),
+			Saturated: ln.saturated.Load(),
+		})
+	}
+	for host, b := range rp.table.Load().backends {
+		out.Hosts = append(out.Hosts, HostSnapshot{
+			Host:           host,
+			Backend:        b.addr,
+			Conns:          b.bucket.len(),
+			MaxConns:       b.bucket.cap(),
+			StreamConns:    b.stream.len(),
+			MaxStreamConns: b.stream.cap(),
+			Requests:       b.stats.requests.Load(),
+			Errors:         b.stats.errors.Load(),
+			Truncated:      b.stats.truncated.Load(),
+			LatencyP50:     b.stats.latency.quantile(0.5).Seconds(),
+			LatencyP99:     b.stats.latency.quantile(0.99).Seconds(),
+			Concurrency:    b.stats.concurrencySnapshot(),
+
+			LatencyObjective: time.Duration(b.route.LatencyObjective).Seconds(),
+			SLORequests:      b.stats.sloRequests.Load(),
+			SLOViolations:    b.stats.sloViolations.Load(),
+			SLORatio:         b.stats.sloRatio(),
+		})
+	}
+	sort.Slice(out.Hosts, func(i, j int) bool { return out.Hosts[i].Host < out.Hosts[j].Host })
+	return out
+}
+
+func (s *backendStats) concurrencySnapshot() []ConcurrencyBand {
+	var out []ConcurrencyBand
+	for i := range s.byConcurrency {
+		h := &s.byConcurrency[i]
+		n := h.count()
+		if n == 0 {
+			continue
+		}
+		max := 1 << i
+		if i == concurrencyBands-1 {
+			max = -1
+		}
+		out = append(out, ConcurrencyBand{
+			Max:        max,
+			Requests:   n,
+			LatencyP50: h.quantile(0.5).Seconds(),
+			LatencyP99: h.quantile(0.99).Seconds(),
+		})
+	}
+	return out
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"os"
+)
+
+// APIKeyConfig makes requests rejected unless they carry one of accepted
+// keys in Header
+type APIKeyConfig struct {
+	Header string
+	// Keys are accepted header values
+	Keys []string `json:",omitempty"`
+	// KeysFile is a path to file with more accepted values, one per line;
+	// empty lines and lines starting with # are ignored. It's read when
+	// configuration is loaded.
+	KeysFile string `json:",omitempty"`
+	// Status is sent for requests without valid key, 401 or 403;
+	// 401 if unset
+	Status int `json:",omitempty"`
+	// Strip removes header from requests before they are sent to backend
+	Strip bool `json:",omitempty"`
+}
+
+func (c *APIKeyConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.Header == "" {
+		return errors.New("APIKey.Header should be set")
+	}
+	if len(c.Keys) == 0 && c.KeysFile == "" {
+		return errors.New("APIKey: one of Keys and KeysFile should be set")
+	}
+	switch c.Status {
+	case 0, http.StatusUnauthorized, http.StatusForbidden:
+	default:
+		return errors.New("APIKey.Status should be 401 or 403")
+	}
+	return nil
+}
+
+// apiKeys is a loaded APIKeyConfig. Key digests are compared, so that time
+// of comparison doesn't depend on key length either.
+type apiKeys struct {
+	header  string
+	digests [][sha256.Size]byte
+	status  int
+	strip   bool
+}
+
+func (c *APIKeyConfig) load() (*apiKeys, error) {
+	if c == nil {
+		return nil, nil
+	}
+	k := &apiKeys{header: c.Header, status: c.Status, strip: c.Strip}
+	if k.status == 0 {
+		k.status = http.StatusUnauthorized
+	}
+	keys := c.Keys
+	if c.KeysFile != "" {
+		b, err := os.ReadFile(c.KeysFile)
+		if err != nil {
+			return nil, err
+		}
+		sc := bufio.NewScanner(bytes.NewReader(b))
+		for sc.Scan() {
+			line := bytes.TrimSpace(sc.Bytes())
+			if len(line) == 0 || line[0] == '#' {
+				continue
+			}
+			keys = append(keys, string(line))
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("APIKey: no keys provided")
+	}
+	for _, key := range keys {
+		k.digests = append(k.digests, sha256.Sum256([]byte(key)))
+	}
+	return k, nil
+}
+
+// check reports whether r carries valid key. All keys are compared, so that
+// time of check doesn't tell which one is closer to match.
+func (k *apiKeys) check(r *http.Request) bool {
+	vals := r.Header.Values(k.header)
+	if len(vals) != 1 || vals[0] == "" {
+		return false
+	}
+	got := sha256.Sum256([]byte(vals[0]))
+	var ok int
+	for i := range k.digests {
+		ok |= subtle.ConstantTimeCompare(got[:], k.digests[i][:])
+	}
+	return ok == 1
+}
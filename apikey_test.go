@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAPIKey(t *testing.T) {
+	backend := echoBackend(t, "X-Api-Key")
+	keysFile := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(keysFile, []byte("# partners\nfile-key\n\n  spaced-key  \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rp := newTestProxy(t, map[string]Route{
+		"a": {Backend: backend, APIKey: &APIKeyConfig{
+			Header:   "X-Api-Key",
+			Keys:     []string{"secret"},
+			KeysFile: keysFile,
+		}},
+		"strip": {Backend: backend, APIKey: &APIKeyConfig{
+			Header: "X-Api-Key",
+			Keys:   []string{"secret"},
+			Status: http.StatusForbidden,
+			Strip:  true,
+		}},
+	})
+	for _, tc := range []struct {
+		host   string
+		keys   []string
+		status int
+		body   string
+	}{
+		{"a", nil, 401, "Unauthorized\n"},
+		{"a", []string{""}, 401, "Unauthorized\n"},
+		{"a", []string{"wrong"}, 401, "Unauthorized\n"},
+		{"a", []string{"secre"}, 401, "Unauthorized\n"},
+		{"a", []string{"secret", "secret"}, 401, "Unauthorized\n"},
+		{"a", []string{"# partners"}, 401, "Unauthorized\n"},
+		{"a", []string{"secret"}, 200, "secret"},
+		{"a", []string{"file-key"}, 200, "file-key"},
+		{"a", []string{"spaced-key"}, 200, "spaced-key"},
+		{"strip", []string{"wrong"}, 403, "Forbidden\n"},
+		{"strip", []string{"secret"}, 200, ""},
+	} {
+		r := httptest.NewRequest("GET", "http://"+tc.host+"/", nil)
+		r.Header["X-Api-Key"] = tc.keys
+		w := serve(rp, r)
+		if w.Code != tc.status || w.Body.String() != tc.body {
+			t.Errorf("%s with keys %q: got %d %q, want %d %q", tc.host, tc.keys, w.Code, w.Body.String(), tc.status, tc.body)
+		}
+	}
+}
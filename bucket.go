@@ -0,0 +1,52 @@
+package main
+
+import "sync/atomic"
+
+// bucket limits number of concurrent requests; unlike buffered channel its
+// capacity can be changed while in use
+type bucket struct {
+	n   atomic.Int64
+	max atomic.Int64
+}
+
+func newBucket(max int) *bucket {
+	b := new(bucket)
+	b.max.Store(int64(max))
+	return b
+}
+
+// tryAcquire takes a slot if bucket is not full and reports whether it did
+func (b *bucket) tryAcquire() bool {
+	for {
+		n := b.n.Load()
+		if n >= b.max.Load() {
+			return false
+		}
+		if b.n.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+func (b *bucket) release() { b.n.Add(-1) }
+
+// resize sets new capacity. Shrinking bucket below its current occupancy
+// doesn't affect requests in flight, but no new ones are admitted until
+// occupancy drops below new capacity.
+func (b *bucket) resize(max int) { b.max.Store(int64(max)) }
+
+// len returns number of taken slots; it is safe to call on nil bucket
+func (b *bucket) len() int {
+	if b == nil {
+		return 0
+	}
+	return int(b.n.Load())
+}
+
+// cap returns bucket capacity; it is safe to call on nil bucket
+func (b *bucket) cap() int {
+	if b == nil {
+		return 0
+	}
+	return int(b.max.Load())
+}
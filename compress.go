@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CompressConfig enables gzip compression of backend responses for clients
+// accepting it. Only responses with one of ContentTypes at least MinSize bytes
+// long are compressed; responses that already have Content-Encoding are passed
+// as is.
+type CompressConfig struct {
+	// MinSize is a minimal size of response to compress, 1024 if zero. If
+	// backend doesn't tell response size, up to MinSize bytes of it are
+	// buffered to find out.
+	MinSize int64 `json:",omitempty"`
+	// ContentTypes are media types to compress, in the same form as
+	// StreamingConfig.ContentTypes; defaultCompressTypes are used if empty
+	ContentTypes []string `json:",omitempty"`
+}
+
+const defaultCompressMinSize = 1024
+
+// defaultCompressTypes are common textual formats. Types like text/* are
+// deliberately not used, so event streams are not held in compressor buffer.
+var defaultCompressTypes = []string{
+	"text/html",
+	"text/plain",
+	"text/css",
+	"text/javascript",
+	"text/xml",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"image/svg+xml",
+}
+
+func (c *CompressConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.MinSize < 0 {
+		return errors.New("Compress.MinSize should not be negative")
+	}
+	for _, s := range c.ContentTypes {
+		if !strings.Contains(s, "/") {
+			return errors.New("Compress.ContentTypes should only hold media types")
+		}
+	}
+	return nil
+}
+
+// compressResponse replaces body of r with gzip-compressed one if client and
+// response qualify. It is expected to be used as ModifyResponse hook.
+func (c *CompressConfig) compressResponse(r *http.Response) error {
+	if r.StatusCode == http.StatusNotModified && acceptsGzip(r.Request.Header) {
+		// validator should match one of response that could be
+		// compressed; weakening it is safe even if it wasn't
+		weakenEtag(r.Header)
+		return nil
+	}
+	switch {
+	case r.Request.Method == http.MethodHead,
+		r.StatusCode < 200, r.StatusCode == http.StatusNoContent,
+		r.StatusCode == http.StatusPartialContent,
+		r.StatusCode == http.StatusNotModified,
+		r.Header.Get("Content-Encoding") != "",
+		len(r.Trailer) != 0,
+		strings.Contains(r.Header.Get("Cache-Control"), "no-transform"):
+		return nil
+	}
+	types := c.ContentTypes
+	if len(types) == 0 {
+		types = defaultCompressTypes
+	}
+	if !matchMediaType(r.Header.Get("Content-Type"), types) {
+		return nil
+	}
+	r.Header.Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(r.Request.Header) {
+		return nil
+	}
+	minSize := c.MinSize
+	if minSize == 0 {
+		minSize = defaultCompressMinSize
+	}
+	body := r.Body
+	src := io.Reader(body)
+	switch {
+	case r.ContentLength >= 0 && r.ContentLength < minSize:
+		return nil
+	case r.ContentLength < 0:
+		buf := make([]byte, minSize)
+		n, err := io.ReadFull(body, buf)
+		switch err {
+		case nil:
+			src = io.MultiReader(bytes.NewReader(buf), body)
+		case io.EOF, io.ErrUnexpectedEOF:
+			// whole response is smaller than minSize, pass it
+			// with known length
+			r.Body = readCloser{Reader: bytes.NewReader(buf[:n]), Closer: body}
+			r.ContentLength = int64(n)
+			r.Header.Set("Content-Length", strconv.Itoa(n))
+			return nil
+		default:
+			return err
+		}
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, src)
+		if err == nil {
+			err = zw.Close()
+		}
+		body.Close()
+		pw.CloseWithError(err)
+	}()
+	r.Body = readCloser{Reader: pr, Closer: closers{pr, body}}
+	r.ContentLength = -1
+	r.Header.Del("Content-Length")
+	r.Header.Del("Accept-Ranges")
+	r.Header.Set("Content-Encoding", "gzip")
+	// compressed representation is not byte-for-byte the same
+	weakenEtag(r.Header)
+	return nil
+}
+
+// weakenEtag turns strong Etag into weak one
+func weakenEtag(h http.Header) {
+	if etag := h.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("Etag", "W/"+etag)
+	}
+}
+
+// acceptsGzip reports whether Accept-Encoding header allows gzip
+func acceptsGzip(h http.Header) bool {
+	for _, v := range h.Values("Accept-Encoding") {
+		for _, s := range strings.Split(v, ",") {
+			coding, params, _ := strings.Cut(s, ";")
+			if strings.ToLower(strings.TrimSpace(coding)) != "gzip" {
+				continue
+			}
+			q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+			if !ok {
+				return true
+			}
+			if f, err := strconv.ParseFloat(q, 64); err != nil || f > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// closers closes all its elements
+type closers []io.Closer
+
+func (cs closers) Close() error {
+	var err error
+	for _, c := range cs {
+		if e := c.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
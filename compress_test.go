@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	text := strings.Repeat("hello, world\n", 1000)
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	io.WriteString(zw, text)
+	zw.Close()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, "tiny")
+		case "/small-chunked":
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, "tiny")
+			w.(http.Flusher).Flush()
+		case "/text":
+			w.Header().Set("Etag", `"v1"`)
+			if r.Header.Get("If-None-Match") != "" {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			io.WriteString(w, text)
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			io.WriteString(w, text)
+		case "/gzipped":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(gzipped.Bytes())
+		}
+	}))
+	defer backend.Close()
+	rp := newTestProxy(t, map[string]Route{"a": {Backend: backend.URL, Compress: &CompressConfig{}}})
+
+	for _, tc := range []struct {
+		path, accept string
+		gzip         bool
+		body         string
+	}{
+		{"/small", "gzip", false, "tiny"},
+		{"/small-chunked", "gzip", false, "tiny"},
+		{"/text", "gzip, deflate", true, text},
+		{"/text", "gzip;q=0", false, text},
+		{"/text", "identity", false, text},
+		{"/image", "gzip", false, text},
+		// already compressed response is passed as is
+		{"/gzipped", "gzip", true, text},
+	} {
+		r := httptest.NewRequest("GET", "http://a"+tc.path, nil)
+		r.Header.Set("Accept-Encoding", tc.accept)
+		w := serve(rp, r)
+		var body io.Reader = w.Body
+		if gz := w.Header().Get("Content-Encoding") == "gzip"; gz != tc.gzip {
+			t.Errorf("%s, Accept-Encoding %q: compressed %v, want %v", tc.path, tc.accept, gz, tc.gzip)
+			continue
+		} else if gz {
+			zr, err := gzip.NewReader(body)
+			if err != nil {
+				t.Errorf("%s: %v", tc.path, err)
+				continue
+			}
+			body = zr
+		}
+		if b, err := io.ReadAll(body); err != nil || string(b) != tc.body {
+			t.Errorf("%s, Accept-Encoding %q: got %d bytes (%v), want %d", tc.path, tc.accept, len(b), err, len(tc.body))
+		}
+	}
+
+	r := httptest.NewRequest("GET", "http://a/text", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := serve(rp, r)
+	if etag := w.Header().Get("Etag"); etag != `W/"v1"` {
+		t.Errorf("compressed response has Etag %q, want weak one", etag)
+	}
+	if v := w.Header().Get("Vary"); v != "Accept-Encoding" {
+		t.Errorf("compressed response has Vary %q", v)
+	}
+	if cl := w.Header().Get("Content-Length"); cl != "" {
+		t.Errorf("compressed response has Content-Length %s of original one", cl)
+	}
+
+	r = httptest.NewRequest("GET", "http://a/text", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	r.Header.Set("If-None-Match", `W/"v1"`)
+	w = serve(rp, r)
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("got status %d to conditional request, want 304", w.Code)
+	}
+	if etag := w.Header().Get("Etag"); etag != `W/"v1"` {
+		t.Errorf("304 response has Etag %q, want one of compressed response", etag)
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, GZIP", true},
+		{"br;q=1.0, gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.000", false},
+		{"x-gzip", false},
+	} {
+		h := http.Header{"Accept-Encoding": {tc.header}}
+		if got := acceptsGzip(h); got != tc.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tc.header, got, tc.want)
+		}
+	}
+}
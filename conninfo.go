@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+)
+
+// connInfoKey is a connection context key for *connInfo
+type connInfoKey struct{}
+
+// connInfo holds state of a single client connection shared by requests
+// received over it
+type connInfo struct {
+	cert     atomic.Pointer[tls.Certificate] // presented on TLS connection
+	requests atomic.Int64                    // requests being served
+}
+
+// withConnInfo is suitable to be used as http.Server.ConnContext
+func withConnInfo(ctx context.Context, _ net.Conn) context.Context {
+	return context.WithValue(ctx, connInfoKey{}, new(connInfo))
+}
+
+// acquireConnSlot accounts request in connInfo from ctx, unless max
+// requests are already served over the same connection. If it returns true,
+// release should be called once request completes.
+func acquireConnSlot(ctx context.Context, max int) (release func(), ok bool) {
+	c, found := ctx.Value(connInfoKey{}).(*connInfo)
+	if !found {
+		return func() {}, true
+	}
+	if c.requests.Add(1) > int64(max) {
+		c.requests.Add(-1)
+		return nil, false
+	}
+	return func() { c.requests.Add(-1) }, true
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+func TestMaxRequestsPerConn(t *testing.T) {
+	const limit = 3
+	arrived := make(chan struct{}, 10)
+	unblock := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			arrived <- struct{}{}
+			<-unblock
+		}
+	}))
+	defer backend.Close()
+	rp := newTestProxyConf(t, Config{
+		MaxRequestsPerConn: limit,
+		Mapping:            map[string]Route{"a": {Backend: backend.URL}},
+	})
+	srv := httptest.NewUnstartedServer(rp)
+	srv.Config.ConnContext = withConnInfo
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	// newConn returns client using single HTTP/2 connection
+	newConn := func() *http2.ClientConn {
+		t.Helper()
+		conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"h2"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cc, err := new(http2.Transport).NewClientConn(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { cc.Close() })
+		return cc
+	}
+	get := func(cc *http2.ClientConn, path string) (int, string) {
+		req, err := http.NewRequest("GET", "https://a"+path, nil)
+		if err != nil {
+			panic(err)
+		}
+		resp, err := cc.RoundTrip(req)
+		if err != nil {
+			t.Error(err)
+			return 0, ""
+		}
+		resp.Body.Close()
+		return resp.StatusCode, resp.Header.Get("Retry-After")
+	}
+
+	cc := newConn()
+	var wg sync.WaitGroup
+	for i := 0; i < limit; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if code, _ := get(cc, "/slow"); code != 200 {
+				t.Errorf("request within limit got status %d", code)
+			}
+		}()
+	}
+	for i := 0; i < limit; i++ {
+		<-arrived
+	}
+	// streams over the limit are refused while others are in flight
+	for i := 0; i < 5; i++ {
+		if code, retry := get(cc, "/"); code != http.StatusServiceUnavailable || retry == "" {
+			t.Errorf("request over limit got status %d, Retry-After %q; want 503 with Retry-After", code, retry)
+		}
+	}
+	// other connections are not affected
+	if code, _ := get(newConn(), "/"); code != 200 {
+		t.Errorf("request over another connection got status %d", code)
+	}
+	close(unblock)
+	wg.Wait()
+	if code, _ := get(cc, "/"); code != 200 {
+		t.Errorf("request after others completed got status %d", code)
+	}
+}
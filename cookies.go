@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// CookieLimits restricts Cookie request headers. Zero values mean defaults,
+// negative ones disable the limit.
+type CookieLimits struct {
+	// MaxSize is a maximum total size of Cookie headers, 16KiB by default
+	MaxSize int `json:",omitempty"`
+	// MaxCount is a maximum number of cookies, 128 by default
+	MaxCount int `json:",omitempty"`
+	// Status is used to reject requests exceeding limits, 431 by default
+	Status int `json:",omitempty"`
+}
+
+func (c *CookieLimits) validate() error {
+	if c != nil && c.Status != 0 && (c.Status < 400 || c.Status > 599) {
+		return errors.New("Cookies.Status should be 4xx or 5xx")
+	}
+	return nil
+}
+
+// withDefaults returns copy of limits with zero values set to defaults; it
+// accepts nil receiver
+func (c *CookieLimits) withDefaults() CookieLimits {
+	var out CookieLimits
+	if c != nil {
+		out = *c
+	}
+	if out.MaxSize == 0 {
+		out.MaxSize = 16 << 10
+	}
+	if out.MaxCount == 0 {
+		out.MaxCount = 128
+	}
+	if out.Status == 0 {
+		out.Status = http.StatusRequestHeaderFieldsTooLarge
+	}
+	return out
+}
+
+// check returns false if cookies of r exceed limits
+func (c CookieLimits) check(r *http.Request) bool {
+	var size, count int
+	for _, v := range r.Header["Cookie"] {
+		size += len(v)
+		count += strings.Count(v, ";") + 1
+	}
+	return (c.MaxSize < 0 || size <= c.MaxSize) && (c.MaxCount < 0 || count <= c.MaxCount)
+}
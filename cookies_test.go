@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCookieLimits(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	routes := map[string]Route{"a": {Backend: backend.URL}}
+	many := func(n int) string {
+		s := make([]string, n)
+		for i := range s {
+			s[i] = "c=1"
+		}
+		return strings.Join(s, "; ")
+	}
+	for _, tc := range []struct {
+		name    string
+		limits  *CookieLimits
+		cookies []string
+		status  int
+	}{
+		{"no cookies", nil, nil, 200},
+		{"default count", nil, []string{many(128)}, 200},
+		{"default count exceeded", nil, []string{many(129)}, 431},
+		{"default size exceeded", nil, []string{"c=" + strings.Repeat("x", 16<<10)}, 431},
+		{"size over several headers", &CookieLimits{MaxSize: 10}, []string{"a=12", "b=123456"}, 431},
+		{"count over several headers", &CookieLimits{MaxCount: 2}, []string{"a=1", "b=2; c=3"}, 431},
+		{"custom status", &CookieLimits{MaxCount: 1, Status: 400}, []string{"a=1; b=2"}, 400},
+		{"limits disabled", &CookieLimits{MaxSize: -1, MaxCount: -1}, []string{many(1000)}, 200},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rp := newTestProxyConf(t, Config{Cookies: tc.limits, Mapping: routes})
+			r := httptest.NewRequest("GET", "http://a/", nil)
+			r.Header["Cookie"] = tc.cookies
+			if w := serve(rp, r); w.Code != tc.status {
+				t.Errorf("got status %d, want %d", w.Code, tc.status)
+			}
+		})
+	}
+}
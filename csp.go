@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// CSPConfig enables Content-Security-Policy header with per-response nonce.
+// Nonce is passed to backend in request header, so it can be used in inline
+// script and style tags.
+type CSPConfig struct {
+	// Policy is a header value, every "{nonce}" in it is replaced with
+	// nonce, i.e. "script-src 'nonce-{nonce}'"
+	Policy string
+	// Header is a name of request header carrying nonce to backend,
+	// "X-CSP-Nonce" by default
+	Header string `json:",omitempty"`
+}
+
+const cspNoncePlaceholder = "{nonce}"
+
+func (c *CSPConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if !strings.Contains(c.Policy, cspNoncePlaceholder) {
+		return errors.New("CSP.Policy has no " + cspNoncePlaceholder + " placeholder")
+	}
+	return nil
+}
+
+func (c *CSPConfig) header() string {
+	if c.Header == "" {
+		return "X-CSP-Nonce"
+	}
+	return c.Header
+}
+
+// setNonce generates nonce and sets it as request header, replacing any
+// value sent by client. It is expected to be called from Director.
+func (c *CSPConfig) setNonce(r *http.Request) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	r.Header.Set(c.header(), base64.StdEncoding.EncodeToString(b[:]))
+}
+
+// setPolicy sets Content-Security-Policy header using nonce sent to backend.
+// It is expected to be called from ModifyResponse.
+func (c *CSPConfig) setPolicy(resp *http.Response) error {
+	nonce := resp.Request.Header.Get(c.header())
+	if nonce == "" {
+		return nil
+	}
+	resp.Header.Set("Content-Security-Policy", strings.ReplaceAll(c.Policy, cspNoncePlaceholder, nonce))
+	return nil
+}
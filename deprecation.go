@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+)
+
+// DeprecationConfig adds headers announcing API deprecation to responses:
+// Deprecation (RFC 9745), Sunset (RFC 8594) and Link to documentation.
+// Deprecation and Sunset headers set by backend are left as is, Link is added
+// to ones backend sent.
+type DeprecationConfig struct {
+	// Date is a time API was or will be deprecated, in RFC 3339 format
+	Date string `json:",omitempty"`
+	// Sunset is a time API is expected to stop responding, in RFC 3339
+	// format
+	Sunset string `json:",omitempty"`
+	// Link is an url of document describing deprecation
+	Link string `json:",omitempty"`
+	// Paths are path.Match patterns limiting requests headers are added
+	// to, matched against path sent to backend (after Rewrite); if empty,
+	// headers are added to all responses
+	Paths []string `json:",omitempty"`
+}
+
+func (c *DeprecationConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.Date == "" && c.Sunset == "" {
+		return errors.New("Deprecation: at least one of Date and Sunset should be set")
+	}
+	for _, s := range []string{c.Date, c.Sunset} {
+		if s == "" {
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339, s); err != nil {
+			return fmt.Errorf("Deprecation: %w", err)
+		}
+	}
+	for _, p := range c.Paths {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("Deprecation: %w", err)
+		}
+	}
+	return nil
+}
+
+// headers returns ModifyResponse hook adding deprecation headers; c should
+// already be validated
+func (c *DeprecationConfig) headers() func(*http.Response) error {
+	set := make(http.Header)
+	if t, err := time.Parse(time.RFC3339, c.Date); err == nil {
+		set.Set("Deprecation", "@"+strconv.FormatInt(t.Unix(), 10))
+	}
+	if t, err := time.Parse(time.RFC3339, c.Sunset); err == nil {
+		set.Set("Sunset", t.UTC().Format(http.TimeFormat))
+	}
+	if c.Link != "" {
+		set.Set("Link", "<"+c.Link+`>; rel="deprecation"`)
+	}
+	return func(r *http.Response) error {
+		if !c.match(r.Request.URL.Path) {
+			return nil
+		}
+		for k, v := range set {
+			if k == "Link" || r.Header.Get(k) == "" {
+				r.Header[k] = append(r.Header[k], v...)
+			}
+		}
+		return nil
+	}
+}
+
+func (c *DeprecationConfig) match(p string) bool {
+	if len(c.Paths) == 0 {
+		return true
+	}
+	for _, pat := range c.Paths {
+		if ok, _ := path.Match(pat, p); ok {
+			return true
+		}
+	}
+	return false
+}
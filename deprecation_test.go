@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestDeprecation(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/own" {
+			w.Header().Set("Sunset", "Sat, 01 May 2027 00:00:00 GMT")
+			w.Header().Set("Link", `</next>; rel="successor-version"`)
+		}
+	}))
+	defer backend.Close()
+	conf := &DeprecationConfig{
+		Date:   "2026-01-01T00:00:00Z",
+		Sunset: "2027-01-01T00:00:00+00:00",
+		Link:   "https://example.com/deprecation",
+		Paths:  []string{"/v1/*"},
+	}
+	rp := newTestProxy(t, map[string]Route{
+		"a": {Backend: backend.URL, Deprecation: conf},
+		"b": {Backend: backend.URL},
+		"c": {Backend: backend.URL, Deprecation: conf, Rewrite: []RewriteRule{
+			{Pattern: `^/old/(.*)$`, Replace: `/v1/$1`},
+		}},
+	})
+	const (
+		date   = "@1767225600"
+		sunset = "Fri, 01 Jan 2027 00:00:00 GMT"
+		link   = `<https://example.com/deprecation>; rel="deprecation"`
+	)
+	for _, tc := range []struct {
+		url                 string
+		deprecation, sunset string
+		links               []string
+	}{
+		{"http://a/v1/users", date, sunset, []string{link}},
+		{"http://a/v2/users", "", "", nil},
+		{"http://b/v1/users", "", "", nil},
+		// paths are matched after rewrite
+		{"http://c/old/users", date, sunset, []string{link}},
+		{"http://c/v2/users", "", "", nil},
+		// backend headers are kept, Link is added to them
+		{"http://a/v1/own", date, "Sat, 01 May 2027 00:00:00 GMT",
+			[]string{`</next>; rel="successor-version"`, link}},
+	} {
+		h := serve(rp, httptest.NewRequest("GET", tc.url, nil)).Header()
+		if got := h.Get("Deprecation"); got != tc.deprecation {
+			t.Errorf("%s: Deprecation %q, want %q", tc.url, got, tc.deprecation)
+		}
+		if got := h.Get("Sunset"); got != tc.sunset {
+			t.Errorf("%s: Sunset %q, want %q", tc.url, got, tc.sunset)
+		}
+		if got := h.Values("Link"); !slices.Equal(got, tc.links) {
+			t.Errorf("%s: Link %q, want %q", tc.url, got, tc.links)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// EmptyResponseConfig configures handling of backends that close connection
+// without sending any response, including HTTP/2 backends closing connection
+// after GOAWAY frame
+type EmptyResponseConfig struct {
+	// Retry enables single retry of idempotent requests without body.
+	// Requests matching RetryRequests are retried regardless of it.
+	Retry bool
+	// Status is a status code of response sent to client, 502 if unset
+	Status int
+	// Page is a path to file with response body, read once on startup
+	Page string
+
+	// RetryRequests lists requests with body that are safe to retry as
+	// well, i.e. POST requests carrying idempotency key. Their bodies are
+	// buffered, so they can be sent again; requests with bodies larger
+	// than MaxRetryBody are not retried.
+	RetryRequests []RetryRule `json:",omitempty"`
+	// MaxRetryBody is a maximum size of buffered body, 64KiB if zero
+	MaxRetryBody int64 `json:",omitempty"`
+}
+
+// RetryRule matches requests with body that can be retried
+type RetryRule struct {
+	Method string
+	// Path is a path.Match pattern matched against path of client
+	// request, before Rewrite and backend path are applied
+	Path string
+	// Header, if set, is a name of header request must have to be
+	// retried, i.e. "Idempotency-Key"
+	Header string `json:",omitempty"`
+}
+
+const defaultMaxRetryBody = 64 << 10
+
+// retryBodyKey is a context key marking client requests matching
+// RetryRequests, as outgoing request path may be already rewritten
+type retryBodyKey struct{}
+
+func (c *EmptyResponseConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.Status != 0 && (c.Status < 100 || c.Status > 999) {
+		return errors.New("EmptyResponse.Status is invalid")
+	}
+	if c.MaxRetryBody < 0 {
+		return errors.New("EmptyResponse.MaxRetryBody should not be negative")
+	}
+	for _, rule := range c.RetryRequests {
+		if rule.Method == "" {
+			return errors.New("EmptyResponse.RetryRequests: Method should be set")
+		}
+		if _, err := path.Match(rule.Path, ""); err != nil {
+			return fmt.Errorf("EmptyResponse.RetryRequests: %w", err)
+		}
+	}
+	return nil
+}
+
+// retryBody reports whether client request with body matches one of
+// RetryRequests
+func (c *EmptyResponseConfig) retryBody(r *http.Request) bool {
+	for _, rule := range c.RetryRequests {
+		if rule.Method != r.Method || rule.Header != "" && r.Header.Get(rule.Header) == "" {
+			continue
+		}
+		if ok, _ := path.Match(rule.Path, r.URL.Path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *EmptyResponseConfig) maxRetryBody() int64 {
+	if c.MaxRetryBody == 0 {
+		return defaultMaxRetryBody
+	}
+	return c.MaxRetryBody
+}
+
+// isEmptyResponse reports whether err means connection to backend was closed
+// before any response was received. If backend closed connection while
+// request body was still being written, error is either EPIPE or
+// net.ErrClosed, as transport closes connection once it reads EOF from it.
+func isEmptyResponse(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, net.ErrClosed) || isClosedIdle(err) || isGoAway(err)
+}
+
+// isClosedIdle reports whether err is returned by HTTP/1 client when backend
+// closed connection before request was sent over it, i.e. right after
+// accepting it. net/http retries such requests itself only over reused
+// connections. Error is not exported, so it's recognized by its message.
+func isClosedIdle(err error) bool {
+	return strings.Contains(err.Error(), "http: server closed idle connection")
+}
+
+// isGoAway reports whether err is returned by HTTP/2 client for request that
+// backend accepted, but closed connection after sending GOAWAY frame without
+// responding to it. Requests backend didn't accept are retried by net/http
+// itself. Error type is not exported by net/http, so it's recognized by its
+// message.
+func isGoAway(err error) bool {
+	return strings.Contains(err.Error(), "http2: server sent GOAWAY and closed the connection")
+}
+
+// errorHandler returns function suitable as httputil.ReverseProxy
+// ErrorHandler, which responds to empty backend responses according to c.
+// Errors reading request body and timeouts are reported to client as such;
+// other errors are handled the same way as by default handler.
+func (c *EmptyResponseConfig) errorHandler(backend string) (func(http.ResponseWriter, *http.Request, error), error) {
+	status, page := http.StatusBadGateway, []byte(nil)
+	if c != nil {
+		if c.Status != 0 {
+			status = c.Status
+		}
+		if c.Page != "" {
+			var err error
+			if page, err = os.ReadFile(c.Page); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		case errors.As(err, new(gunzipError)):
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		case errors.Is(err, context.DeadlineExceeded),
+			errors.Is(context.Cause(r.Context()), context.DeadlineExceeded):
+			log.Printf("backend %s for %s timed out", backend, r.Host)
+			http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+			return
+		}
+		if !isEmptyResponse(err) {
+			log.Printf("http: proxy error: %v", err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		log.Printf("backend %s for %s closed connection without response: %v", backend, r.Host, err)
+		if page == nil {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		w.Header().Set("Content-Type", http.DetectContentType(page))
+		w.WriteHeader(status)
+		w.Write(page)
+	}, nil
+}
+
+// retryEmptyTransport retries idempotent requests without body if conf.Retry
+// is set, and ones matching conf.RetryRequests, once if backend closed
+// connection without response
+type retryEmptyTransport struct {
+	http.RoundTripper
+	conf *EmptyResponseConfig
+}
+
+func (t retryEmptyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	retry := t.conf.Retry && isIdempotent(r.Method)
+	if r.Body != nil && r.Body != http.NoBody {
+		retry = false
+		if r.Context().Value(retryBodyKey{}) != nil {
+			r, retry = bufferBody(r, t.conf.maxRetryBody())
+		}
+	}
+	resp, err := t.RoundTripper.RoundTrip(r)
+	if err == nil || !isEmptyResponse(err) || !retry || r.Context().Err() != nil {
+		return resp, err
+	}
+	if r.GetBody != nil {
+		r2 := new(http.Request)
+		*r2 = *r
+		if r2.Body, err = r.GetBody(); err != nil {
+			return nil, err
+		}
+		r = r2
+	}
+	return t.RoundTripper.RoundTrip(r)
+}
+
+// bufferBody reads up to max bytes of r body and returns copy of r with
+// body that can be replayed with GetBody. If body is larger or can't be read,
+// returned request sends whatever was read followed by the rest of original
+// body, and false is reported.
+func bufferBody(r *http.Request, max int64) (*http.Request, bool) {
+	buf, err := io.ReadAll(io.LimitReader(r.Body, max+1))
+	r2 := new(http.Request)
+	*r2 = *r
+	if err != nil || int64(len(buf)) > max {
+		r2.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(buf), r.Body), Closer: r.Body}
+		return r2, false
+	}
+	body := r.Body
+	r2.GetBody = func() (io.ReadCloser, error) {
+		return readCloser{Reader: bytes.NewReader(buf), Closer: body}, nil
+	}
+	r2.Body, _ = r2.GetBody()
+	return r2, true
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace,
+		http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
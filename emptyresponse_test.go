@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// closingBackend returns address of server that closes the first drop
+// connections right after accepting them and serves the rest with h. The
+// number of accepted connections is counted in conns.
+func closingBackend(t *testing.T, drop int32, h http.Handler) (addr string, conns *atomic.Int32) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns = new(atomic.Int32)
+	served := make(chan net.Conn)
+	srv := &http.Server{Handler: h}
+	go srv.Serve(&chanListener{Listener: ln, conns: served})
+	go func() {
+		defer close(served)
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if conns.Add(1) <= drop {
+				c.Close()
+				continue
+			}
+			served <- c
+		}
+	}()
+	t.Cleanup(func() { ln.Close(); srv.Close() })
+	return ln.Addr().String(), conns
+}
+
+// chanListener passes connections received over a channel to http.Server
+type chanListener struct {
+	net.Listener
+	conns chan net.Conn
+}
+
+func (l *chanListener) Accept() (net.Conn, error) {
+	c, ok := <-l.conns
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return c, nil
+}
+
+// TestIsEmptyResponse ensures errors net/http returns for connection closed
+// by backend right after accepting it are recognized, including ones matched
+// by error text
+func TestIsEmptyResponse(t *testing.T) {
+	addr, _ := closingBackend(t, 1, http.NotFoundHandler())
+	tr := &http.Transport{}
+	// let transport notice connection is closed by backend before request
+	// is sent over it
+	trace := &httptrace.ClientTrace{GotConn: func(httptrace.GotConnInfo) { time.Sleep(50 * time.Millisecond) }}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace),
+		"GET", "http://"+addr+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := tr.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatalf("got %s response over closed connection", resp.Status)
+	}
+	if !isClosedIdle(err) || !isEmptyResponse(err) {
+		t.Fatalf("error is not recognized as connection closed by backend: %v", err)
+	}
+}
+
+func TestEmptyResponse(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") })
+	page := filepath.Join(t.TempDir(), "page.html")
+	if err := os.WriteFile(page, []byte("<h1>down</h1>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	retryPost := &EmptyResponseConfig{RetryRequests: []RetryRule{{Method: "POST", Path: "/*"}}}
+	for _, tc := range []struct {
+		name     string
+		conf     *EmptyResponseConfig
+		method   string
+		size     int // of request body
+		status   int
+		body     string
+		attempts int32
+	}{
+		{"default", nil, "GET", 0, http.StatusBadGateway, "Bad Gateway", 1},
+		{"status and page", &EmptyResponseConfig{Status: 503, Page: page}, "GET", 0, 503, "<h1>down</h1>", 1},
+		// backend closes connection while body is still being written
+		{"status and page for large body", &EmptyResponseConfig{Status: 503, Page: page}, "POST", 4 << 20, 503, "<h1>down</h1>", 1},
+		{"retry", &EmptyResponseConfig{Retry: true}, "GET", 0, 200, "ok", 2},
+		{"no retry of post", &EmptyResponseConfig{Retry: true}, "POST", 4, 502, "Bad Gateway", 1},
+		{"retry requests without retry", retryPost, "POST", 4, 200, "ok", 2},
+		{"no retry of get without retry", retryPost, "GET", 0, 502, "Bad Gateway", 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			addr, conns := closingBackend(t, 1, ok)
+			rp := newTestProxy(t, map[string]Route{"a": {Backend: "http://" + addr, EmptyResponse: tc.conf}})
+			var body io.Reader
+			if tc.size > 0 {
+				body = strings.NewReader(strings.Repeat("x", tc.size))
+			}
+			w := serve(rp, httptest.NewRequest(tc.method, "http://a/", body))
+			if w.Code != tc.status || strings.TrimSpace(w.Body.String()) != tc.body {
+				t.Errorf("got %d %q, want %d %q", w.Code, w.Body.String(), tc.status, tc.body)
+			}
+			if n := conns.Load(); n != tc.attempts {
+				t.Errorf("backend got %d connections, want %d", n, tc.attempts)
+			}
+		})
+	}
+}
+
+// goAwayBackend returns address of HTTP/2 over TLS server that accepts the
+// first request, but sends GOAWAY frame and closes connection instead of
+// responding to it. Requests over later connections get empty 200 response.
+// The number of accepted connections is counted in conns.
+func goAwayBackend(t *testing.T) (addr string, conns *atomic.Int32) {
+	t.Helper()
+	pair := writeKeyPair(t, t.TempDir(), "backend", "127.0.0.1")
+	cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	conns = new(atomic.Int32)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeH2(c, conns.Add(1) == 1)
+		}
+	}()
+	return ln.Addr().String(), conns
+}
+
+// serveFakeH2 serves HTTP/2 connection responding to every request with
+// empty 200 response, or if goAway is set, sending GOAWAY frame that covers
+// the first request and closing connection
+func serveFakeH2(c net.Conn, goAway bool) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	if _, err := io.ReadFull(br, make([]byte, len(http2.ClientPreface))); err != nil {
+		return
+	}
+	fr := http2.NewFramer(c, br)
+	fr.WriteSettings()
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			return
+		}
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				fr.WriteSettingsAck()
+			}
+		case *http2.HeadersFrame:
+			if goAway {
+				fr.WriteGoAway(f.StreamID, http2.ErrCodeNo, nil)
+				return
+			}
+			var block bytes.Buffer
+			hpack.NewEncoder(&block).WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
+			fr.WriteHeaders(http2.HeadersFrameParam{
+				StreamID:      f.StreamID,
+				BlockFragment: block.Bytes(),
+				EndStream:     true,
+				EndHeaders:    true,
+			})
+		}
+	}
+}
+
+// TestIsGoAway ensures isGoAway still recognizes error net/http returns when
+// backend closes connection with GOAWAY, as it matches error text
+func TestIsGoAway(t *testing.T) {
+	addr, _ := goAwayBackend(t)
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	defer tr.CloseIdleConnections()
+	req, err := http.NewRequest("GET", "https://"+addr+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := tr.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatalf("got %s response to request backend didn't respond to", resp.Status)
+	}
+	if !isGoAway(err) || !isEmptyResponse(err) {
+		t.Fatalf("error is not recognized as GOAWAY: %v", err)
+	}
+}
+
+func TestEmptyResponseGoAway(t *testing.T) {
+	for _, tc := range []struct {
+		retry    bool
+		status   int
+		attempts int32
+	}{
+		{false, http.StatusBadGateway, 1},
+		{true, http.StatusOK, 2},
+	} {
+		addr, conns := goAwayBackend(t)
+		rp := newTestProxy(t, map[string]Route{"a": {
+			Backend:       "https://" + addr,
+			EmptyResponse: &EmptyResponseConfig{Retry: tc.retry},
+		}})
+		rp.transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		w := serve(rp, httptest.NewRequest("GET", "http://a/", nil))
+		rp.transport.CloseIdleConnections()
+		if w.Code != tc.status {
+			t.Errorf("Retry %v: got status %d, want %d", tc.retry, w.Code, tc.status)
+		}
+		if n := conns.Load(); n != tc.attempts {
+			t.Errorf("Retry %v: backend got %d connections, want %d", tc.retry, n, tc.attempts)
+		}
+	}
+}
+
+func TestEmptyResponseRetryBody(t *testing.T) {
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.Copy(w, r.Body) })
+	const max = 1 << 20
+	conf := &EmptyResponseConfig{
+		Retry:         true,
+		MaxRetryBody:  max,
+		RetryRequests: []RetryRule{{Method: "POST", Path: "/pay/*", Header: "Idempotency-Key"}},
+	}
+	// bodies are large enough for backend to always close connection while
+	// body is still being written
+	for _, tc := range []struct {
+		name, base, path, key string
+		size                  int
+		status                int
+		attempts              int32
+	}{
+		{"replayed", "", "/pay/1", "k1", max / 2, 200, 2},
+		{"body at cap", "", "/pay/1", "k1", max, 200, 2},
+		{"body over cap", "", "/pay/1", "k1", max + 1, 502, 1},
+		{"no idempotency key", "", "/pay/1", "", max / 2, 502, 1},
+		{"path not matched", "", "/refund/1", "k1", max / 2, 502, 1},
+		// rule matches client path, not the one sent to backend
+		{"backend base path", "/api", "/pay/1", "k1", max / 2, 200, 2},
+		{"path matched after base path", "/pay", "/1", "k1", max / 2, 502, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			addr, conns := closingBackend(t, 1, echo)
+			rp := newTestProxy(t, map[string]Route{"a": {Backend: "http://" + addr + tc.base, EmptyResponse: conf}})
+			body := strings.Repeat("x", tc.size)
+			r := httptest.NewRequest("POST", "http://a"+tc.path, strings.NewReader(body))
+			if tc.key != "" {
+				r.Header.Set("Idempotency-Key", tc.key)
+			}
+			w := serve(rp, r)
+			if w.Code != tc.status {
+				t.Errorf("got status %d, want %d", w.Code, tc.status)
+			}
+			if tc.status == 200 && w.Body.String() != body {
+				t.Errorf("backend got %d bytes of body on retry, want %d", w.Body.Len(), len(body))
+			}
+			if n := conns.Load(); n != tc.attempts {
+				t.Errorf("backend got %d connections, want %d", n, tc.attempts)
+			}
+		})
+	}
+}
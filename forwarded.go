@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ipNets is a set of networks, used to match trusted proxies
+type ipNets []*net.IPNet
+
+// parseIPNets parses list of CIDR networks or single IP addresses
+func parseIPNets(list []string) (ipNets, error) {
+	var out ipNets
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func (n ipNets) contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, x := range n {
+		if x.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns IP address of immediate peer, or nil if it cannot be
+// parsed
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// clientIP returns address of the client that originated request. If
+// immediate peer is a trusted proxy, elements of Forwarded header are walked
+// starting from the nearest one until address that is not a trusted proxy is
+// found. If some trusted proxy reported obfuscated or unknown client, address
+// of that proxy is returned.
+func (t *routeTable) clientIP(r *http.Request) net.IP {
+	ip := remoteIP(r)
+	if !t.trusted.contains(ip) {
+		return ip
+	}
+	elems, err := parseForwarded(r.Header["Forwarded"])
+	if err != nil {
+		return ip
+	}
+	for i := len(elems) - 1; i >= 0; i-- {
+		next := parseNode(elems[i]["for"])
+		if next == nil {
+			break
+		}
+		ip = next
+		if !t.trusted.contains(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// scheme returns scheme of request as seen by client: "https" if request was
+// received over TLS, or if immediate peer is a trusted proxy that reported it
+// with X-Forwarded-Proto header; "http" otherwise.
+func (t *routeTable) scheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if vv := r.Header["X-Forwarded-Proto"]; len(vv) != 0 && t.trusted.contains(remoteIP(r)) {
+		v := vv[len(vv)-1]
+		if i := strings.LastIndexByte(v, ','); i >= 0 {
+			// the last value is set by the immediate peer, earlier ones
+			// may come from anyone
+			v = v[i+1:]
+		}
+		if strings.EqualFold(strings.TrimSpace(v), "https") {
+			return "https"
+		}
+	}
+	return "http"
+}
+
+// setForwarded adds Forwarded header element describing request r as
+// received by proxy. It is expected to be called from Director.
+func (t *routeTable) setForwarded(r *http.Request) {
+	ip := remoteIP(r)
+	if !t.trusted.contains(ip) {
+		r.Header.Del("Forwarded")
+	}
+	var pairs []string
+	if s := formatNode(ip); s != "" {
+		pairs = append(pairs, "for="+s)
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if tcp, ok := addr.(*net.TCPAddr); ok {
+			pairs = append(pairs, "by="+formatNode(tcp.IP))
+		}
+	}
+	if r.Host != "" {
+		pairs = append(pairs, "host="+quoteForwarded(r.Host))
+	}
+	pairs = append(pairs, "proto="+t.scheme(r))
+	elem := strings.Join(pairs, ";")
+	if prior := r.Header["Forwarded"]; len(prior) > 0 {
+		elem = strings.Join(prior, ", ") + ", " + elem
+	}
+	r.Header.Set("Forwarded", elem)
+}
+
+// formatNode formats ip as RFC 7239 node: IPv6 addresses are enclosed in
+// brackets and quoted
+func formatNode(ip net.IP) string {
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return ip.String()
+	}
+	return `"[` + ip.String() + `]"`
+}
+
+// parseNode extracts IP address from unquoted RFC 7239 node value ("for" or
+// "by" parameter), optionally carrying port. It returns nil for "unknown"
+// and obfuscated identifiers.
+func parseNode(s string) net.IP {
+	if strings.HasPrefix(s, "[") {
+		i := strings.IndexByte(s, ']')
+		if i < 0 {
+			return nil
+		}
+		return net.ParseIP(s[1:i])
+	}
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		s = s[:i]
+	}
+	return net.ParseIP(s)
+}
+
+// quoteForwarded returns s as is if it is a valid token, or as a quoted
+// string otherwise
+func quoteForwarded(s string) string {
+	for i := 0; i < len(s); i++ {
+		if !isTokenChar(s[i]) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+		}
+	}
+	return s
+}
+
+// parseForwarded parses values of RFC 7239 Forwarded header into list of
+// elements, each being a map of lowercased parameter names to unquoted
+// values.
+func parseForwarded(values []string) ([]map[string]string, error) {
+	var out []map[string]string
+	for _, v := range values {
+		elem := make(map[string]string)
+		for i := 0; ; {
+			i = skipSpace(v, i)
+			if i == len(v) {
+				break
+			}
+			j := i
+			for j < len(v) && isTokenChar(v[j]) {
+				j++
+			}
+			if j == i || j == len(v) || v[j] != '=' {
+				return nil, fmt.Errorf("malformed Forwarded header: %q", v)
+			}
+			name := strings.ToLower(v[i:j])
+			val, n, err := readForwardedValue(v[j+1:])
+			if err != nil {
+				return nil, err
+			}
+			elem[name] = val
+			i = skipSpace(v, j+1+n)
+			if i == len(v) {
+				break
+			}
+			switch v[i] {
+			case ';':
+				i++
+				continue
+			case ',':
+				out = append(out, elem)
+				elem = make(map[string]string)
+				i++
+				continue
+			}
+			return nil, fmt.Errorf("malformed Forwarded header: %q", v)
+		}
+		if len(elem) > 0 {
+			out = append(out, elem)
+		}
+	}
+	return out, nil
+}
+
+// readForwardedValue reads token or quoted string from the start of s,
+// returning unquoted value and number of bytes consumed
+func readForwardedValue(s string) (string, int, error) {
+	if s == "" || s[0] != '"' {
+		i := 0
+		for i < len(s) && isTokenChar(s[i]) {
+			i++
+		}
+		return s[:i], i, nil
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return b.String(), i + 1, nil
+		case '\\':
+			if i++; i == len(s) {
+				return "", 0, errUnterminatedQuote
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return "", 0, errUnterminatedQuote
+}
+
+var errUnterminatedQuote = errors.New("malformed Forwarded header: unterminated quoted string")
+
+func skipSpace(s string, i int) int {
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+		i++
+	}
+	return i
+}
+
+// isTokenChar reports whether c is a valid RFC 7230 token character
+func isTokenChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// echoBackend returns url of backend responding with value of request
+// header name
+func echoBackend(t *testing.T, name string) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get(name)))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestForwardedProto(t *testing.T) {
+	backend := echoBackend(t, "X-Forwarded-Proto")
+	for _, tc := range []struct {
+		name    string
+		trusted []string
+		values  []string
+		want    string
+	}{
+		{"no header", []string{"192.0.2.1"}, nil, "http"},
+		{"trusted peer", []string{"192.0.2.0/24"}, []string{"https"}, "https"},
+		{"untrusted peer", []string{"198.51.100.1"}, []string{"https"}, "http"},
+		// values before the last one come from client of trusted peer
+		{"spoofed by client", []string{"192.0.2.1"}, []string{"https, http"}, "http"},
+		{"spoofed in separate header", []string{"192.0.2.1"}, []string{"https", "http"}, "http"},
+		{"appended by trusted peer", []string{"192.0.2.1"}, []string{"http,https"}, "https"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rp := newTestProxyConf(t, Config{
+				TrustedProxies: tc.trusted,
+				Mapping:        map[string]Route{"a": {Backend: backend}},
+			})
+			r := httptest.NewRequest("GET", "http://a/", nil) // from 192.0.2.1
+			r.Header["X-Forwarded-Proto"] = tc.values
+			if got := serve(rp, r).Body.String(); got != tc.want {
+				t.Errorf("backend got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	backend := echoBackend(t, "X-Forwarded-For")
+	for _, tc := range []struct {
+		name      string
+		trusted   []string
+		keep      bool
+		value     string
+		forwarded string
+		want      string
+	}{
+		{"trusted peer", []string{"192.0.2.1"}, false, "203.0.113.7", "", "203.0.113.7, 192.0.2.1"},
+		{"trusted network", []string{"192.0.2.0/24"}, false, "203.0.113.7", "", "203.0.113.7, 192.0.2.1"},
+		{"untrusted peer", []string{"198.51.100.1"}, false, "203.0.113.7", "", "192.0.2.1"},
+		{"no trusted proxies", nil, false, "203.0.113.7", "", "192.0.2.1"},
+		{"untrusted peer kept", nil, true, "203.0.113.7", "", "203.0.113.7, 192.0.2.1"},
+		{"no header", nil, false, "", "", "192.0.2.1"},
+		{"from Forwarded", []string{"192.0.2.1"}, false, "", "for=203.0.113.7", "203.0.113.7, 192.0.2.1"},
+		{"from Forwarded IPv6", []string{"192.0.2.1"}, false, "", `for="[2001:db8::1]:443"`, "2001:db8::1, 192.0.2.1"},
+		{"Forwarded of untrusted peer", nil, false, "", "for=203.0.113.7", "192.0.2.1"},
+		{"Forwarded with obfuscated node", []string{"192.0.2.1"}, false, "", "for=_hidden", "192.0.2.1"},
+		{"both headers", []string{"192.0.2.1"}, false, "203.0.113.7", "for=198.51.100.9", "203.0.113.7, 192.0.2.1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rp := newTestProxyConf(t, Config{
+				TrustedProxies:            tc.trusted,
+				KeepUntrustedForwardedFor: tc.keep,
+				Mapping:                   map[string]Route{"a": {Backend: backend}},
+			})
+			r := httptest.NewRequest("GET", "http://a/", nil) // from 192.0.2.1
+			if tc.value != "" {
+				r.Header.Set("X-Forwarded-For", tc.value)
+			}
+			if tc.forwarded != "" {
+				r.Header.Set("Forwarded", tc.forwarded)
+			}
+			if got := serve(rp, r).Body.String(); got != tc.want {
+				t.Errorf("backend got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		trusted []string
+		values  []string
+		want    string
+	}{
+		{"no header", []string{"192.0.2.1"}, nil, "192.0.2.1"},
+		{"untrusted peer", []string{"198.51.100.0/24"}, []string{"for=203.0.113.7"}, "192.0.2.1"},
+		{"trusted peer", []string{"192.0.2.1"}, []string{"for=203.0.113.7"}, "203.0.113.7"},
+		{"chain of trusted proxies", []string{"192.0.2.1", "198.51.100.0/24"},
+			[]string{"for=203.0.113.7, for=198.51.100.2"}, "203.0.113.7"},
+		{"spoofed before untrusted node", []string{"192.0.2.1"},
+			[]string{"for=198.51.100.1, for=203.0.113.7"}, "203.0.113.7"},
+		{"separate headers", []string{"192.0.2.1", "198.51.100.0/24"},
+			[]string{"for=203.0.113.7", "for=198.51.100.2"}, "203.0.113.7"},
+		{"IPv6 with port", []string{"192.0.2.1"}, []string{`for="[2001:db8::1]:443"`}, "2001:db8::1"},
+		{"IPv4 with port", []string{"192.0.2.1"}, []string{`for="203.0.113.7:8080"`}, "203.0.113.7"},
+		{"unknown", []string{"192.0.2.1", "198.51.100.0/24"},
+			[]string{"for=unknown, for=198.51.100.2"}, "198.51.100.2"},
+		{"obfuscated", []string{"192.0.2.1"}, []string{"for=_hidden"}, "192.0.2.1"},
+		{"malformed", []string{"192.0.2.1"}, []string{"for=203.0.113.7 by=x"}, "192.0.2.1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			trusted, err := parseIPNets(tc.trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "http://a/", nil) // from 192.0.2.1
+			r.Header["Forwarded"] = tc.values
+			rt := &routeTable{trusted: trusted}
+			if got := rt.clientIP(r); got.String() != tc.want {
+				t.Errorf("got %v, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseForwarded(t *testing.T) {
+	type elem = map[string]string
+	for _, tc := range []struct {
+		values []string
+		want   []elem // nil if parsing should fail
+	}{
+		{[]string{"for=192.0.2.1"}, []elem{{"for": "192.0.2.1"}}},
+		{[]string{"For=192.0.2.1;Proto=https"}, []elem{{"for": "192.0.2.1", "proto": "https"}}},
+		{[]string{"for=192.0.2.1, for=198.51.100.2"}, []elem{{"for": "192.0.2.1"}, {"for": "198.51.100.2"}}},
+		{[]string{"for=192.0.2.1", "for=198.51.100.2"}, []elem{{"for": "192.0.2.1"}, {"for": "198.51.100.2"}}},
+		{[]string{` for = "x" `}, nil},
+		{[]string{`for="[2001:db8::1]:443"`}, []elem{{"for": "[2001:db8::1]:443"}}},
+		{[]string{`host="a\"b";for=_hidden`}, []elem{{"host": `a"b`, "for": "_hidden"}}},
+		{[]string{`for=unknown ; proto=http`}, []elem{{"for": "unknown", "proto": "http"}}},
+		{[]string{`for="192.0.2.1`}, nil},
+		{[]string{"for=192.0.2.1;;proto=http"}, nil},
+		{[]string{"192.0.2.1"}, nil},
+		{[]string{"for=192.0.2.1 by=x"}, nil},
+	} {
+		got, err := parseForwarded(tc.values)
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("%q: got %v, want error", tc.values, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.values, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %v, want %v", tc.values, got, tc.want)
+		}
+	}
+}
+
+func TestFormatNode(t *testing.T) {
+	for _, tc := range []struct {
+		ip   net.IP
+		want string
+	}{
+		{nil, ""},
+		{net.ParseIP("192.0.2.1"), "192.0.2.1"},
+		{net.ParseIP("::ffff:192.0.2.1"), "192.0.2.1"},
+		{net.ParseIP("2001:db8::1"), `"[2001:db8::1]"`},
+	} {
+		if got := formatNode(tc.ip); got != tc.want {
+			t.Errorf("%v: got %s, want %s", tc.ip, got, tc.want)
+		}
+		if tc.ip == nil {
+			continue
+		}
+		// formatted node should be read back
+		elems, err := parseForwarded([]string{"for=" + formatNode(tc.ip)})
+		if err != nil {
+			t.Errorf("%v: %v", tc.ip, err)
+			continue
+		}
+		if ip := parseNode(elems[0]["for"]); !ip.Equal(tc.ip) {
+			t.Errorf("%v: read back as %v", tc.ip, ip)
+		}
+	}
+}
+
+func TestQuoteForwarded(t *testing.T) {
+	for _, tc := range []struct {
+		s, want string
+	}{
+		{"example.com", "example.com"},
+		{"example.com:8080", `"example.com:8080"`},
+		{`a"b\c`, `"a\"b\\c"`},
+		{"", ""},
+	} {
+		if got := quoteForwarded(tc.s); got != tc.want {
+			t.Errorf("%q: got %s, want %s", tc.s, got, tc.want)
+		}
+		if tc.s == "" {
+			continue
+		}
+		elems, err := parseForwarded([]string{"host=" + quoteForwarded(tc.s)})
+		if err != nil || elems[0]["host"] != tc.s {
+			t.Errorf("%q: read back as %v, %v", tc.s, elems, err)
+		}
+	}
+}
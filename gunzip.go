@@ -0,0 +1,73 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// GunzipConfig enables transparent decompression of gzip-encoded request
+// bodies for backends that can't handle them
+type GunzipConfig struct {
+	// MaxSize is a maximum allowed size of decompressed body; requests
+	// exceeding it are rejected with 413 status
+	MaxSize int64
+}
+
+func (c *GunzipConfig) validate() error {
+	if c != nil && c.MaxSize < 1 {
+		return errors.New("Gunzip.MaxSize is too low")
+	}
+	return nil
+}
+
+// gunzipRequest replaces gzip-encoded body of r with decompressing reader.
+// Since decompressed size is unknown, request is sent with chunked encoding.
+// It is expected to be called from Director.
+func (c *GunzipConfig) gunzipRequest(r *http.Request) {
+	if r.Body == nil || r.Body == http.NoBody || len(r.Header["Content-Encoding"]) != 1 {
+		return
+	}
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "gzip", "x-gzip":
+	default:
+		return
+	}
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	r.ContentLength = -1
+	r.Body = http.MaxBytesReader(nil, &gunzipReader{body: r.Body}, c.MaxSize)
+}
+
+// gunzipReader decompresses body; gzip stream header is read on first Read
+// call, so that it happens in transport and not in Director. Decompression
+// errors are returned wrapped in gunzipError.
+type gunzipReader struct {
+	body io.ReadCloser
+	zr   *gzip.Reader
+}
+
+func (g *gunzipReader) Read(p []byte) (int, error) {
+	if g.zr == nil {
+		zr, err := gzip.NewReader(g.body)
+		if err != nil {
+			return 0, gunzipError{err}
+		}
+		g.zr = zr
+	}
+	n, err := g.zr.Read(p)
+	if err != nil && err != io.EOF {
+		err = gunzipError{err}
+	}
+	return n, err
+}
+
+func (g *gunzipReader) Close() error { return g.body.Close() }
+
+// gunzipError is an error of request body decompression
+type gunzipError struct{ err error }
+
+func (e gunzipError) Error() string { return "request body decompression: " + e.err.Error() }
+func (e gunzipError) Unwrap() error { return e.err }
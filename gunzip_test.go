@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGunzip(t *testing.T) {
+	text := strings.Repeat("hello, world\n", 100)
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	io.WriteString(zw, text)
+	zw.Close()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "%q %d %s", r.Header.Get("Content-Encoding"), r.ContentLength, b)
+	}))
+	defer backend.Close()
+	rp := newTestProxy(t, map[string]Route{
+		"a":     {Backend: backend.URL, Gunzip: &GunzipConfig{MaxSize: int64(len(text))}},
+		"small": {Backend: backend.URL, Gunzip: &GunzipConfig{MaxSize: int64(len(text)) - 1}},
+	})
+	for _, tc := range []struct {
+		name, host, encoding string
+		body                 []byte
+		status               int
+		want                 string // received by backend
+	}{
+		// decompressed size is not known in advance
+		{"decompressed", "a", "gzip", gzipped.Bytes(), 200, `"" -1 ` + text},
+		{"x-gzip", "a", "x-gzip", gzipped.Bytes(), 200, `"" -1 ` + text},
+		{"over MaxSize", "small", "gzip", gzipped.Bytes(), http.StatusRequestEntityTooLarge, ""},
+		{"not gzip", "a", "gzip", []byte(text), http.StatusBadRequest, ""},
+		{"truncated", "a", "gzip", gzipped.Bytes()[:gzipped.Len()/2], http.StatusBadRequest, ""},
+		{"other encoding", "a", "br", []byte("xyz"), 200, `"br" 3 xyz`},
+		{"no encoding", "a", "", []byte("xyz"), 200, `"" 3 xyz`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "http://"+tc.host+"/", bytes.NewReader(tc.body))
+			if tc.encoding != "" {
+				r.Header.Set("Content-Encoding", tc.encoding)
+			}
+			w := serve(rp, r)
+			if w.Code != tc.status {
+				t.Fatalf("got status %d, want %d", w.Code, tc.status)
+			}
+			if tc.status == 200 && w.Body.String() != tc.want {
+				t.Errorf("backend got %.40q, want %.40q", w.Body.String(), tc.want)
+			}
+		})
+	}
+}
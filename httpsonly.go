@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// HTTPSOnlyConfig prevents proxying requests received over plain HTTP
+type HTTPSOnlyConfig struct {
+	// Redirect makes requests redirected to https:// url instead of
+	// refused
+	Redirect bool
+	// Port is a port used in redirect url, if not the default one
+	Port int
+	// Status is used to refuse requests if Redirect is not set, 403 by
+	// default
+	Status int
+}
+
+func (c *HTTPSOnlyConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return errors.New("HTTPSOnly.Port is invalid")
+	}
+	if c.Status != 0 && (c.Status < 400 || c.Status > 599) {
+		return errors.New("HTTPSOnly.Status should be 4xx or 5xx")
+	}
+	return nil
+}
+
+// refuse handles request received over plain HTTP by either redirecting or
+// refusing it
+func (c *HTTPSOnlyConfig) refuse(w http.ResponseWriter, r *http.Request) {
+	if !c.Redirect {
+		status := c.Status
+		if status == 0 {
+			status = http.StatusForbidden
+		}
+		if status == http.StatusUpgradeRequired {
+			w.Header().Set("Upgrade", "TLS/1.2, HTTP/1.1")
+			w.Header().Set("Connection", "Upgrade")
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if c.Port != 0 && c.Port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(c.Port))
+	} else if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		host = "[" + host + "]"
+	}
+	u := *r.URL
+	u.Scheme, u.Host = "https", host
+	http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// idleListener closes accepted connections that transfer no data for longer
+// than timeout while no request is being served over them
+type idleListener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+func (l idleListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	ic := &idleConn{Conn: c, timeout: l.timeout}
+	ic.touch()
+	// timer is started once assigned, so check can use it
+	ic.timer = time.AfterFunc(math.MaxInt64, ic.check)
+	ic.timer.Reset(l.timeout)
+	return ic, nil
+}
+
+// idleConn tracks time of the last read or write. It doesn't use deadlines,
+// so that ones set by http.Server are not affected.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+	timer   *time.Timer
+	last    atomic.Int64 // unix nanoseconds of last activity
+	busy    atomic.Bool  // request is being served
+}
+
+func (c *idleConn) touch() { c.last.Store(time.Now().UnixNano()) }
+
+// check closes connection if it was idle for timeout, otherwise schedules
+// the next check
+func (c *idleConn) check() {
+	if c.busy.Load() {
+		c.timer.Reset(c.timeout)
+		return
+	}
+	idle := time.Duration(time.Now().UnixNano() - c.last.Load())
+	if idle >= c.timeout {
+		c.Conn.Close()
+		return
+	}
+	c.timer.Reset(c.timeout - idle)
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *idleConn) Close() error {
+	c.timer.Stop()
+	return c.Conn.Close()
+}
+
+// trackConnState is suitable to be used as http.Server.ConnState, it
+// suspends idle timeout of connection while it serves requests. Hijacked
+// connections, i.e. websockets, are never closed for being idle.
+func trackConnState(c net.Conn, state http.ConnState) {
+	for {
+		if ic, ok := c.(*idleConn); ok {
+			switch state {
+			case http.StateActive, http.StateHijacked:
+				ic.busy.Store(true)
+			case http.StateIdle:
+				ic.touch()
+				ic.busy.Store(false)
+			}
+			return
+		}
+		u, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			return
+		}
+		c = u.NetConn()
+	}
+}
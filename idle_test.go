@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestConnIdleTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	pair := writeKeyPair(t, t.TempDir(), "server", "127.0.0.1")
+	cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// request taking longer than idle timeout is not interrupted
+		time.Sleep(3 * timeout)
+		io.WriteString(w, "ok")
+	})
+	for _, tc := range []struct {
+		name string
+		tls  bool
+	}{
+		{"plain", false},
+		{"tls", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ln, err := Listen("127.0.0.1:0", 10, timeout, net.ListenConfig{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			dial := func() net.Conn {
+				c, err := net.Dial("tcp", ln.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				c.SetDeadline(time.Now().Add(5 * time.Second))
+				if tc.tls {
+					tlsConn := tls.Client(c, &tls.Config{InsecureSkipVerify: true})
+					if err := tlsConn.Handshake(); err != nil {
+						t.Fatal(err)
+					}
+					return tlsConn
+				}
+				return c
+			}
+			if tc.tls {
+				ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}})
+			}
+			srv := &http.Server{Handler: handler, ConnState: trackConnState}
+			go srv.Serve(ln)
+			defer srv.Close()
+
+			// waitClosed checks that server closes c around timeout
+			waitClosed := func(c net.Conn) {
+				t.Helper()
+				start := time.Now()
+				if _, err := c.Read(make([]byte, 1)); err == nil {
+					t.Fatal("idle connection got data")
+				}
+				if d := time.Since(start); d < timeout/2 || d > 10*timeout {
+					t.Errorf("idle connection closed after %v, timeout is %v", d, timeout)
+				}
+			}
+
+			// connection that never sent a request
+			c := dial()
+			waitClosed(c)
+			c.Close()
+
+			c = dial()
+			defer c.Close()
+			io.WriteString(c, "GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+			resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+			if err != nil {
+				t.Fatalf("slow request: %v", err)
+			}
+			b, err := io.ReadAll(resp.Body)
+			if err != nil || string(b) != "ok" {
+				t.Fatalf("slow request: got %q, %v", b, err)
+			}
+			// keep-alive connection after request completed
+			waitClosed(c)
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// includedConfig is a format of files referenced by Config.Include
+type includedConfig struct {
+	Include []string
+	Mapping map[string]Route
+}
+
+// resolveIncludes merges mappings from files matching conf.Include patterns
+// into conf.Mapping. Included files are JSON objects with Mapping and Include
+// fields only; they may include other files. Relative patterns are resolved
+// against directory of main configuration file name. Host defined in more
+// than one file and include cycles are reported as errors. On success
+// conf.Include is cleared.
+func resolveIncludes(conf *Config, name string) error {
+	main, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+	r := &includeResolver{
+		dir:     filepath.Dir(main),
+		sources: make(map[string]string, len(conf.Mapping)),
+		mapping: conf.Mapping,
+	}
+	if r.mapping == nil {
+		r.mapping = make(map[string]Route)
+	}
+	for k := range r.mapping {
+		r.sources[k] = main
+	}
+	if err := r.include(conf.Include, []string{main}); err != nil {
+		return err
+	}
+	conf.Mapping, conf.Include = r.mapping, nil
+	return nil
+}
+
+type includeResolver struct {
+	dir     string            // directory of main config
+	sources map[string]string // host to file it is defined in
+	mapping map[string]Route
+}
+
+// include processes files matching patterns; stack is a chain of files
+// leading to the current one, used to detect cycles
+func (r *includeResolver) include(patterns []string, stack []string) error {
+	for _, pat := range patterns {
+		if !filepath.IsAbs(pat) {
+			pat = filepath.Join(r.dir, pat)
+		}
+		names, err := filepath.Glob(pat)
+		if err != nil {
+			return fmt.Errorf("%s: include %q: %v", stack[len(stack)-1], pat, err)
+		}
+		for _, name := range names {
+			for _, s := range stack {
+				if s == name {
+					return fmt.Errorf("include cycle: %s -> %s",
+						strings.Join(stack, " -> "), name)
+				}
+			}
+			if err := r.load(name, append(stack, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *includeResolver) load(name string, stack []string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var conf includedConfig
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&conf); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	for k, v := range conf.Mapping {
+		if prev, ok := r.sources[k]; ok {
+			return fmt.Errorf("%s: host %q is already defined in %s", name, k, prev)
+		}
+		if err := v.validate(); err != nil {
+			return fmt.Errorf("%s: %s: %v", name, k, err)
+		}
+		r.sources[k] = name
+		r.mapping[k] = v
+	}
+	return r.include(conf.Include, stack)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// withConnLifetime returns RoundTripper using t, which stops reusing
+// connections older than lifetime: once response received over such
+// connection is read, idle connections of t are closed, so expired connection
+// is discarded instead of being handed to the next request. It modifies t
+// dialer, so t should not be shared with other routes.
+func withConnLifetime(t *http.Transport, lifetime time.Duration) http.RoundTripper {
+	dial := t.DialContext
+	switch {
+	case dial != nil:
+	case t.Dial != nil:
+		d := t.Dial
+		dial = func(_ context.Context, network, addr string) (net.Conn, error) {
+			return d(network, addr)
+		}
+		t.Dial = nil
+	default:
+		dial = (&net.Dialer{}).DialContext
+	}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &agingConn{Conn: conn, deadline: time.Now().Add(lifetime)}, nil
+	}
+	return lifetimeTransport{t}
+}
+
+// agingConn is a connection that knows when it should be retired
+type agingConn struct {
+	net.Conn
+	deadline time.Time
+}
+
+type lifetimeTransport struct {
+	*http.Transport
+}
+
+func (t lifetimeTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	var conn *agingConn
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c := info.Conn
+			if tc, ok := c.(*tls.Conn); ok {
+				c = tc.NetConn()
+			}
+			conn, _ = c.(*agingConn)
+		},
+	}
+	resp, err := t.Transport.RoundTrip(r.WithContext(httptrace.WithClientTrace(r.Context(), trace)))
+	// upgraded connection is not reused, and its body must stay writable
+	if err != nil || conn == nil || time.Now().Before(conn.deadline) ||
+		resp.StatusCode == http.StatusSwitchingProtocols {
+		return resp, err
+	}
+	resp.Body = &retiringBody{ReadCloser: resp.Body, t: t.Transport}
+	return resp, nil
+}
+
+// retiringBody closes idle connections of t once body is done. Transport
+// returns connection to its idle pool before body reports io.EOF, and
+// CloseIdleConnections removes it from there under the same lock the pool
+// uses to hand connections out, so expired connection either gets closed, or
+// is already serving another request, which retires it in turn.
+type retiringBody struct {
+	io.ReadCloser
+	t    *http.Transport
+	once sync.Once
+}
+
+func (b *retiringBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.once.Do(b.t.CloseIdleConnections)
+	}
+	return n, err
+}
+
+func (b *retiringBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.t.CloseIdleConnections)
+	return err
+}
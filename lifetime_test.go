@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConnLifetime(t *testing.T) {
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, "ok")
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	const lifetime = 100 * time.Millisecond
+	for _, tc := range []struct {
+		name string
+		body func() io.Reader
+	}{
+		{"without body", func() io.Reader { return nil }},
+		// body without GetBody, as httputil.ReverseProxy sends it
+		{"with body", func() io.Reader { return io.NopCloser(strings.NewReader("payload")) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conns.Store(0)
+			tr := &http.Transport{}
+			defer tr.CloseIdleConnections()
+			client := &http.Client{Transport: withConnLifetime(tr, lifetime)}
+			do := func() {
+				t.Helper()
+				method := http.MethodGet
+				body := tc.body()
+				if body != nil {
+					method = http.MethodPost
+				}
+				req, err := http.NewRequest(method, srv.URL, body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp, err := client.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil || string(b) != "ok" {
+					t.Fatalf("got %q, %v", b, err)
+				}
+			}
+			do()
+			do()
+			if n := conns.Load(); n != 1 {
+				t.Fatalf("%d connections opened before lifetime expired, want 1", n)
+			}
+			time.Sleep(lifetime + 20*time.Millisecond)
+			do() // still sent over expired connection, which is closed after
+			do()
+			if n := conns.Load(); n != 2 {
+				t.Fatalf("%d connections opened after lifetime expired, want 2", n)
+			}
+		})
+	}
+}
+
+func TestConnLifetimeUpgrade(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+		brw.Flush()
+	}))
+	defer srv.Close()
+	tr := &http.Transport{}
+	defer tr.CloseIdleConnections()
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "test")
+	// every connection is already expired once response is received
+	resp, err := withConnLifetime(tr, time.Nanosecond).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if _, ok := resp.Body.(io.ReadWriteCloser); !ok {
+		t.Fatalf("body of %d response is %T, not writable", resp.StatusCode, resp.Body)
+	}
+}
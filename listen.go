@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// listenerSpec describes listener opened on startup
+type listenerSpec struct {
+	name    string // used as a key in openListeners result and in errors
+	addr    string
+	maxconn int           // 0 means no limit
+	idle    time.Duration // connection idle timeout, only used with maxconn
+	lc      net.ListenConfig
+}
+
+// openListeners opens listeners for all specs, returning them keyed by spec
+// name. Addresses that are already in use are retried until timeout expires.
+// If any listener can't be opened, ones already opened are closed and error
+// naming the failed listener is returned.
+func openListeners(specs []listenerSpec, timeout time.Duration) (map[string]net.Listener, error) {
+	deadline := time.Now().Add(timeout)
+	out := make(map[string]net.Listener, len(specs))
+	for _, spec := range specs {
+		ln, err := spec.listen(deadline)
+		if err != nil {
+			for _, ln := range out {
+				ln.Close()
+			}
+			return nil, fmt.Errorf("%s listener on %s: %w", spec.name, spec.addr, err)
+		}
+		out[spec.name] = ln
+	}
+	return out, nil
+}
+
+func (spec listenerSpec) listen(deadline time.Time) (net.Listener, error) {
+	for {
+		var ln net.Listener
+		var err error
+		if spec.maxconn == 0 {
+			ln, err = spec.lc.Listen(context.Background(), "tcp", spec.addr)
+		} else {
+			ln, err = Listen(spec.addr, spec.maxconn, spec.idle, spec.lc)
+			if l, ok := ln.(*limitListener); ok {
+				l.name = spec.name
+			}
+		}
+		if err == nil || !errors.Is(err, syscall.EADDRINUSE) || time.Now().After(deadline) {
+			return ln, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// limitListener is a listener accepting at most cap(sem) simultaneous
+// connections, like netutil.LimitListener, which also reports when limit
+// is reached
+type limitListener struct {
+	net.Listener
+	name string // used in log messages and stats
+
+	sem       chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+
+	atLimit   atomic.Bool   // Accept is waiting for connection to be closed
+	saturated atomic.Uint64 // times Accept had to wait
+	lastLog   atomic.Int64  // unix nanoseconds of last saturation log message
+}
+
+// saturationLogInterval is a minimal interval between log messages about
+// connection limit being reached
+const saturationLogInterval = time.Minute
+
+func newLimitListener(ln net.Listener, n int) *limitListener {
+	return &limitListener{
+		Listener: ln,
+		sem:      make(chan struct{}, n),
+		done:     make(chan struct{}),
+	}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	var waitStart time.Time
+	select {
+	case l.sem <- struct{}{}:
+	default:
+		waitStart = time.Now()
+		l.saturated.Add(1)
+		l.atLimit.Store(true)
+		select {
+		case l.sem <- struct{}{}:
+			l.atLimit.Store(false)
+		case <-l.done:
+			l.atLimit.Store(false)
+			return nil, net.ErrClosed
+		}
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	if !waitStart.IsZero() {
+		l.logSaturation(c, time.Since(waitStart))
+	}
+	return &limitConn{Conn: c, release: func() { <-l.sem }}, nil
+}
+
+// logSaturation logs that c had to wait d for a free connection slot,
+// unless such message was logged recently
+func (l *limitListener) logSaturation(c net.Conn, d time.Duration) {
+	now := time.Now().UnixNano()
+	last := l.lastLog.Load()
+	if now-last < int64(saturationLogInterval) || !l.lastLog.CompareAndSwap(last, now) {
+		return
+	}
+	log.Printf("%s listener: limit of %d connections reached (%d times so far), client %s waited %v",
+		l.name, cap(l.sem), l.saturated.Load(), c.RemoteAddr(), d.Round(time.Millisecond))
+}
+
+func (l *limitListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.done) })
+	return err
+}
+
+// limitConn releases its slot in limitListener once closed
+type limitConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+// NetConn returns wrapped connection
+func (c *limitConn) NetConn() net.Conn { return c.Conn }
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return err
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// normalizePath cleans escaped url path p: duplicate slashes are collapsed,
+// "." and ".." segments (including percent-encoded ones) are resolved, and
+// trailing slash is preserved. It reports false if ".." segments lead above
+// the root. Paths not starting with "/" (like "*") are returned unchanged.
+func normalizePath(p string) (string, bool) {
+	if !strings.HasPrefix(p, "/") {
+		return p, true
+	}
+	segs := strings.Split(p[1:], "/")
+	out := make([]string, 0, len(segs))
+	trailing := false
+	for _, seg := range segs {
+		dec, err := url.PathUnescape(seg)
+		if err != nil {
+			dec = seg
+		}
+		trailing = true
+		switch dec {
+		case "", ".":
+			continue
+		case "..":
+			if len(out) == 0 {
+				return "", false
+			}
+			out = out[:len(out)-1]
+			continue
+		}
+		trailing = false
+		out = append(out, seg)
+	}
+	if len(out) == 0 {
+		return "/", true
+	}
+	res := "/" + strings.Join(out, "/")
+	if trailing {
+		res += "/"
+	}
+	return res, true
+}
+
+// normalizeURL applies normalizePath to u, reporting false if path escapes
+// the root
+func normalizeURL(u *url.URL) bool {
+	p, ok := normalizePath(u.EscapedPath())
+	if !ok {
+		return false
+	}
+	dec, err := url.PathUnescape(p)
+	if err != nil {
+		return false
+	}
+	u.Path, u.RawPath = dec, p
+	return true
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalizePath(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+		ok       bool
+	}{
+		{"/", "/", true},
+		{"//api///v1", "/api/v1", true},
+		{"/a/./b/.", "/a/b/", true},
+		{"/a/b/", "/a/b/", true},
+		{"/a/b/../c", "/a/c", true},
+		{"/a/..", "/", true},
+		{"/a/%2e%2E/b", "/b", true},
+		{"/a/.%2e/", "/", true},
+		{"/%2E/a", "/a", true},
+		// encoded slash is not a separator, backend sees it escaped
+		{"/a/..%2F..%2Fetc", "/a/..%2F..%2Fetc", true},
+		{"/a/%ZZ/../b", "/a/b", true},
+		{"*", "*", true},
+		// traversal above the root
+		{"/..", "", false},
+		{"/../etc/passwd", "", false},
+		{"/a/../../etc/passwd", "", false},
+		{"//..//etc", "", false},
+		{"/%2e%2e/etc", "", false},
+		{"/a/%2E%2E/%2e%2e/etc", "", false},
+	} {
+		got, ok := normalizePath(tc.in)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("normalizePath(%q) = %q, %v; want %q, %v", tc.in, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestNormalizePathsRouting(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.EscapedPath()))
+	}))
+	defer backend.Close()
+	rp := newTestProxyConf(t, Config{
+		NormalizePaths: true,
+		Mapping:        map[string]Route{"a": {Backend: backend.URL}},
+	})
+	for _, tc := range []struct {
+		target string
+		status int
+		path   string
+	}{
+		{"/public//./files/../index.html", 200, "/public/index.html"},
+		{"/a%20b//c", 200, "/a%20b/c"},
+		{"/public/../../etc/passwd", 400, ""},
+		{"/%2e%2e/%2e%2e/etc/passwd", 400, ""},
+	} {
+		w := serve(rp, httptest.NewRequest("GET", "http://a"+tc.target, nil))
+		if w.Code != tc.status {
+			t.Errorf("%s: got status %d, want %d", tc.target, w.Code, tc.status)
+			continue
+		}
+		if tc.status == 200 && w.Body.String() != tc.path {
+			t.Errorf("%s: backend got path %q, want %q", tc.target, w.Body.String(), tc.path)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// reloader re-reads configuration file and applies it to proxy. Reloads are
+// serialized, so concurrent triggers (signals, admin requests) never race.
+type reloader struct {
+	name  string // configuration file
+	proxy *RevProxy
+
+	mu   sync.Mutex // held during reload
+	last atomic.Pointer[ReloadStatus]
+}
+
+// ReloadStatus describes outcome of configuration reload
+type ReloadStatus struct {
+	Time   time.Time
+	Routes int    `json:",omitempty"` // number of hosts after successful reload
+	Error  string `json:",omitempty"`
+}
+
+func (rl *reloader) reload() ReloadStatus {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	st := ReloadStatus{Time: time.Now()}
+	conf, err := readConfig(rl.name)
+	if err == nil {
+		err = rl.proxy.Reload(conf)
+	}
+	if err != nil {
+		st.Error = err.Error()
+		log.Println("configuration reload:", err)
+	} else {
+		st.Routes = len(conf.Mapping)
+		log.Printf("configuration reloaded, %d hosts", st.Routes)
+	}
+	rl.last.Store(&st)
+	return st
+}
+
+// status returns outcome of the last reload; its Time is zero if there were
+// no reloads yet. It doesn't wait for reload in progress, which may take a
+// while checking backend sockets.
+func (rl *reloader) status() ReloadStatus {
+	if st := rl.last.Load(); st != nil {
+		return *st
+	}
+	return ReloadStatus{}
+}
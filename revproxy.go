@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
@@ -11,29 +14,43 @@ import (
 	_ "net/http/pprof"
 	"net/url"
 	"os"
+	"os/signal"
+	"slices"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
-
-	"golang.org/x/net/netutil"
 )
 
 func main() {
 	params := struct {
 		Addr    string
+		TLSAddr string
 		Conf    string
 		Prof    string
+		Admin   string
+		Token   string
 		MaxConn int
+		Timeout time.Duration
 	}{
 		Addr:    "0.0.0.0:8080",
 		Conf:    "/etc/revproxy.json",
 		MaxConn: 1000,
 	}
 	flag.StringVar(&params.Addr, "addr", params.Addr, "`address` to listen at")
+	flag.StringVar(&params.TLSAddr, "tlsaddr", params.TLSAddr, "`address` to listen at for TLS connections")
 	flag.StringVar(&params.Conf, "conf", params.Conf, "configuration `file` with mapping")
 	flag.StringVar(&params.Prof, "prof", params.Prof, "`address` to expose profile data at")
+	flag.StringVar(&params.Admin, "admin", params.Admin, "`address` to expose admin endpoints at")
+	flag.StringVar(&params.Token, "admintoken", params.Token, "`token` required to access admin endpoints")
 	flag.IntVar(&params.MaxConn, "maxconn", params.MaxConn, "maximum number of connections to accept")
+	flag.DurationVar(&params.Timeout, "bindtimeout", params.Timeout, "how long to retry binding addresses already in use on startup")
 	flag.Parse()
 
+	if params.Admin != "" && params.Token == "" {
+		log.Fatal("admin token is required to expose admin endpoints")
+	}
+
 	conf, err := readConfig(params.Conf)
 	if err != nil {
 		log.Fatal(err)
@@ -44,82 +61,464 @@ func main() {
 		log.Fatal(err)
 	}
 
-	ln, err := Listen(params.Addr, params.MaxConn)
+	var certs *certStore
+	if params.TLSAddr != "" {
+		if certs, err = newCertStore(conf.Certificates); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	lc := net.ListenConfig{Control: conf.SocketBuffers.control}
+	idle := time.Duration(conf.ConnIdleTimeout)
+	specs := []listenerSpec{{name: "http", addr: params.Addr, maxconn: params.MaxConn, idle: idle, lc: lc}}
+	if params.TLSAddr != "" {
+		specs = append(specs, listenerSpec{name: "tls", addr: params.TLSAddr, maxconn: params.MaxConn, idle: idle, lc: lc})
+	}
+	if params.Admin != "" {
+		specs = append(specs, listenerSpec{name: "admin", addr: params.Admin})
+	}
+	if params.Prof != "" {
+		specs = append(specs, listenerSpec{name: "profiling", addr: params.Prof})
+	}
+	lns, err := openListeners(specs, params.Timeout)
 	if err != nil {
 		log.Fatal(err)
 	}
+	for _, spec := range specs {
+		if ln, ok := lns[spec.name].(*limitListener); ok {
+			proxy.listeners = append(proxy.listeners, ln)
+		}
+	}
 
 	srv := &http.Server{
 		Handler:      proxy,
 		ReadTimeout:  65 * time.Second,
 		WriteTimeout: 65 * time.Second,
+		HTTP2:        conf.HTTP2.config(),
+		ConnContext:  withConnInfo,
 	}
-	if params.Prof != "" {
+	if idle > 0 {
+		srv.ConnState = trackConnState
+	}
+	rl := &reloader{name: params.Conf, proxy: proxy}
+	if tln := lns["tls"]; tln != nil {
+		tlsConf := &tls.Config{
+			GetCertificate: certs.GetCertificate,
+			NextProtos:     conf.nextProtos(),
+		}
+		tlsConf.GetConfigForClient = alpnLogger(tlsConf.NextProtos)
+		if !slices.Contains(tlsConf.NextProtos, "h2") {
+			// non-nil empty map disables HTTP/2
+			srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		}
+		srv.ErrorLog = log.New(&proxy.handshakeErrors, "", log.LstdFlags)
+		if d := time.Duration(conf.SessionTicketKeyRotation); d > 0 {
+			if err := rotateSessionTicketKeys(tlsConf, d); err != nil {
+				log.Fatal(err)
+			}
+		}
 		go func() {
-			log.Println(http.ListenAndServe(params.Prof, nil))
+			log.Fatal(srv.Serve(tls.NewListener(tln, tlsConf)))
 		}()
 	}
-	log.Fatal(srv.Serve(ln))
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGHUP)
+		for range sigs {
+			rl.reload()
+			if certs == nil {
+				continue
+			}
+			if err := certs.reload(); err != nil {
+				log.Println("certificates reload:", err)
+				continue
+			}
+			log.Println("certificates reloaded")
+		}
+	}()
+	if ln := lns["admin"]; ln != nil {
+		go func() {
+			log.Println(http.Serve(ln, newAdminHandler(proxy, rl, params.Token)))
+		}()
+	}
+	if ln := lns["profiling"]; ln != nil {
+		go func() {
+			log.Println(http.Serve(ln, nil))
+		}()
+	}
+	log.Fatal(srv.Serve(lns["http"]))
 }
 
-func Listen(addr string, maxconn int) (net.Listener, error) {
+// Listen returns listener accepting at most maxconn simultaneous connections.
+// If idle is positive, connections that transfer no data for that long while
+// not serving requests are closed; this requires http.Server.ConnState to be
+// set to trackConnState.
+func Listen(addr string, maxconn int, idle time.Duration, lc net.ListenConfig) (net.Listener, error) {
 	if maxconn < 1 {
 		return nil, errors.New("maxconn should be positive")
 	}
-	ln, err := net.Listen("tcp", addr)
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
 	if err != nil {
 		return nil, err
 	}
-	return netutil.LimitListener(ln, maxconn), nil
+	if idle > 0 {
+		ln = idleListener{Listener: ln, timeout: idle}
+	}
+	return newLimitListener(ln, maxconn), nil
 }
 
 type RevProxy struct {
-	backends map[string]*httputil.ReverseProxy
-	buckets  map[string]chan struct{}
+	table     atomic.Pointer[routeTable]
+	transport *http.Transport // shared by backends reachable over tcp
+
+	missingHost     atomic.Uint64 // requests rejected for missing Host header
+	conflictingHost atomic.Uint64 // requests rejected for ambiguous Host
+
+	handshakeErrors handshakeErrors
+
+	// listeners with connection limit, reported in stats; only set on
+	// startup
+	listeners []*limitListener
+}
+
+// routeTable holds everything built from a single Config; it is never
+// modified and is replaced as a whole on reload
+type routeTable struct {
+	backends    map[string]*backend
+	trusted     ipNets // trusted proxies
+	defaultHost string
+	accessLog   *AccessLogConfig
+	normalize   bool // whether to normalize request paths
+	cookies     CookieLimits
+	keepXFF     bool // keep X-Forwarded-For from untrusted clients
+
+	rejectMisdirected bool // see Config.RejectMisdirected
+	maxConnRequests   int  // see Config.MaxRequestsPerConn
+
+	inflight atomic.Int64 // requests being served using this table
+}
+
+// backend holds proxy for a single host and buckets limiting number of
+// concurrent requests to it
+type backend struct {
+	route  Route
+	addr   string // backend url or unix socket path
+	proxy  *httputil.ReverseProxy
+	bucket *bucket
+	stats  *backendStats // shared with backend for the same host after reload
+	// stream is a separate bucket for long-lived requests, nil if not
+	// configured
+	stream  *bucket
+	streamC *StreamingConfig
+	// transport is set if backend doesn't use transport shared by all
+	// routes, its idle connections are closed when backend is retired
+	transport *http.Transport
+	static    map[string]*staticContent // keyed by request path
+	responses []responseRule
+	apiKeys   *apiKeys // nil if not required
 }
 
 func NewRevProxy(conf Config) (*RevProxy, error) {
 	if err := conf.validate(); err != nil {
 		return nil, err
 	}
-	rp := &RevProxy{
-		backends: make(map[string]*httputil.ReverseProxy),
-		buckets:  make(map[string]chan struct{}),
-	}
-	transport := http.DefaultTransport
-	transport.(*http.Transport).MaxIdleConnsPerHost = conf.MaxKeepalivesPerBackend
-	for k, v := range conf.Mapping {
-		if strings.HasPrefix(v, "/") {
-			// destination is unix socket. Make a custom transport
-			// which routes any requests into this socket via
-			// custom dialer, construct fake destination url from
-			// source domain itself
-			dst, err := url.Parse("http://" + k)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = conf.MaxKeepalivesPerBackend
+	if conf.ForwardProxy != "" {
+		u, err := parseForwardProxy(conf.ForwardProxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	rp := &RevProxy{transport: transport}
+	t, err := rp.newRouteTable(conf, nil)
+	if err != nil {
+		return nil, err
+	}
+	rp.table.Store(t)
+	return rp, nil
+}
+
+// Reload replaces proxy routes with ones built from conf. Requests already
+// in flight are completed using previous routes. Settings of listeners
+// (including ConnIdleTimeout), MaxKeepalivesPerBackend and ForwardProxy are
+// not affected by reload.
+func (rp *RevProxy) Reload(conf Config) error {
+	if err := conf.validate(); err != nil {
+		return err
+	}
+	t, err := rp.newRouteTable(conf, rp.table.Load())
+	if err != nil {
+		return err
+	}
+	go rp.table.Swap(t).retire()
+	return nil
+}
+
+// retire closes idle connections of transports dedicated to t backends once
+// requests served using t complete. It must only be called after t is
+// replaced, so it no longer gets new requests. Connections that become idle
+// after that are closed by transport's IdleConnTimeout.
+func (t *routeTable) retire() {
+	for t.inflight.Load() > 0 {
+		time.Sleep(100 * time.Millisecond)
+	}
+	for _, b := range t.backends {
+		if b.transport != nil {
+			b.transport.CloseIdleConnections()
+		}
+	}
+}
+
+// newRouteTable builds routes from conf, which should already be validated.
+// If prev is not nil, request statistics of hosts present in prev are carried
+// over.
+func (rp *RevProxy) newRouteTable(conf Config, prev *routeTable) (*routeTable, error) {
+	t := &routeTable{
+		backends:    make(map[string]*backend),
+		defaultHost: conf.DefaultHost,
+		accessLog:   conf.AccessLog,
+		normalize:   conf.NormalizePaths,
+		cookies:     conf.Cookies.withDefaults(),
+		keepXFF:     conf.KeepUntrustedForwardedFor,
+
+		rejectMisdirected: conf.RejectMisdirected,
+		maxConnRequests:   conf.MaxRequestsPerConn,
+	}
+	var err error
+	if t.trusted, err = parseIPNets(conf.TrustedProxies); err != nil {
+		return nil, err
+	}
+	static, err := loadStaticPaths(nil, conf.StaticPaths)
+	if err != nil {
+		return nil, err
+	}
+	for k, route := range conf.Mapping {
+		transport := rp.transport
+		if route.ForwardProxy != "" || route.UpstreamSNI != "" || route.MaxConnLifetime > 0 {
+			transport = transport.Clone()
+		}
+		if route.ForwardProxy != "" {
+			u, err := parseForwardProxy(route.ForwardProxy)
 			if err != nil {
 				return nil, err
 			}
-			rp.buckets[k] = make(chan struct{}, conf.MaxConnsPerBackend)
-			p := httputil.NewSingleHostReverseProxy(dst)
-			v := v // shadow variable
-			p.Transport = &http.Transport{
-				Dial: func(network, addr string) (net.Conn, error) {
-					return net.Dial("unix", v)
-				},
+			transport.Proxy = http.ProxyURL(u)
+		}
+		if route.UpstreamSNI != "" {
+			if transport.TLSClientConfig == nil {
+				transport.TLSClientConfig = new(tls.Config)
 			}
-			rp.backends[k] = p
-			continue
+			transport.TLSClientConfig.ServerName = route.UpstreamSNI
 		}
-		// treat destination as tcp
-		dst, err := url.Parse(v)
+		p, err := newSingleHostProxy(k, route.Backend, transport)
+		if err != nil {
+			return nil, err
+		}
+		var own *http.Transport
+		if tr, ok := p.Transport.(*http.Transport); ok && tr != rp.transport {
+			own = tr
+		}
+		p.Transport = route.transport(p.Transport)
+		director := p.Director
+		p.Director = func(r *http.Request) {
+			director(r)
+			// replace value that could be set by client
+			r.Header.Set("X-Forwarded-Proto", t.scheme(r))
+			// httputil.ReverseProxy appends client address to
+			// X-Forwarded-For, drop chain it can't vouch for
+			switch ip := remoteIP(r); {
+			case t.trusted.contains(ip):
+				// trusted proxy may only report client with
+				// Forwarded header
+				if _, ok := r.Header["X-Forwarded-For"]; !ok {
+					if c := t.clientIP(r); !c.Equal(ip) {
+						r.Header.Set("X-Forwarded-For", c.String())
+					}
+				}
+			case !t.keepXFF:
+				r.Header.Del("X-Forwarded-For")
+			}
+		}
+		if p.ErrorHandler, err = route.EmptyResponse.errorHandler(route.Backend); err != nil {
+			return nil, err
+		}
+		if len(route.Rewrite) != 0 {
+			rw, err := compileRewrites(route.Rewrite)
+			if err != nil {
+				return nil, err
+			}
+			director := p.Director
+			p.Director = func(r *http.Request) {
+				rw.rewrite(r.URL)
+				director(r)
+			}
+		}
+		if route.Forwarded {
+			director := p.Director
+			p.Director = func(r *http.Request) {
+				director(r)
+				t.setForwarded(r)
+			}
+		}
+		if tc := route.TimeoutHeader; tc != nil && route.Timeout > 0 {
+			director := p.Director
+			p.Director = func(r *http.Request) {
+				director(r)
+				tc.setHeader(r)
+			}
+		}
+		if gc := route.Gunzip; gc != nil {
+			director := p.Director
+			p.Director = func(r *http.Request) {
+				director(r)
+				gc.gunzipRequest(r)
+			}
+		}
+		b := &backend{
+			route:  route,
+			addr:   route.Backend,
+			proxy:  p,
+			bucket: newBucket(conf.MaxConnsPerBackend),
+			stats:  new(backendStats),
+
+			transport: own,
+		}
+		if b.static, err = loadStaticPaths(static, route.StaticPaths); err != nil {
+			return nil, fmt.Errorf("%s: %v", k, err)
+		}
+		if b.responses, err = loadResponseRules(route.Responses); err != nil {
+			return nil, fmt.Errorf("%s: %v", k, err)
+		}
+		if b.apiKeys, err = route.APIKey.load(); err != nil {
+			return nil, fmt.Errorf("%s: %v", k, err)
+		}
+		if prev != nil && prev.backends[k] != nil {
+			b.stats = prev.backends[k].stats
+		}
+		if route.Timeout > 0 {
+			addModifyResponse(p, stopResponseTimeout)
+		}
+		addModifyResponse(p, func(r *http.Response) error {
+			// body of upgraded connection must stay writable
+			if r.StatusCode != http.StatusSwitchingProtocols {
+				r.Body = &truncationBody{ReadCloser: r.Body, backend: route.Backend, host: k, stats: b.stats}
+			}
+			return nil
+		})
+		if sc := route.Streaming; sc != nil {
+			b.stream = newBucket(sc.MaxConns)
+			b.streamC = sc
+			addModifyResponse(p, func(r *http.Response) error {
+				if s, ok := r.Request.Context().Value(slotKey{}).(*slot); ok &&
+					sc.matchContentType(r.Header.Get("Content-Type")) {
+					s.moveTo(b.stream)
+				}
+				return nil
+			})
+		}
+		if cc := route.CSP; cc != nil {
+			director := p.Director
+			p.Director = func(r *http.Request) {
+				director(r)
+				cc.setNonce(r)
+			}
+			addModifyResponse(p, cc.setPolicy)
+		}
+		if cc := route.Compress; cc != nil {
+			addModifyResponse(p, cc.compressResponse)
+		}
+		if dc := route.Deprecation; dc != nil {
+			addModifyResponse(p, dc.headers())
+		}
+		t.backends[k] = b
+	}
+	return t, nil
+}
+
+// parseForwardProxy parses and validates url of outbound proxy
+func parseForwardProxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("forward proxy %q: unsupported scheme", s)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("forward proxy %q: no host", s)
+	}
+	return u, nil
+}
+
+// isHostname reports whether s is a syntactically valid DNS hostname, not an
+// IP address
+func isHostname(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if s == "" || len(s) > 253 || net.ParseIP(s) != nil {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// addModifyResponse makes fn called after already set p.ModifyResponse
+func addModifyResponse(p *httputil.ReverseProxy, fn func(*http.Response) error) {
+	prev := p.ModifyResponse
+	if prev == nil {
+		p.ModifyResponse = fn
+		return
+	}
+	p.ModifyResponse = func(r *http.Response) error {
+		if err := prev(r); err != nil {
+			return err
+		}
+		return fn(r)
+	}
+}
+
+// newSingleHostProxy returns proxy forwarding requests to backend, which is
+// either url or absolute path to unix socket.
+func newSingleHostProxy(host, backend string, transport http.RoundTripper) (*httputil.ReverseProxy, error) {
+	if strings.HasPrefix(backend, "/") {
+		// destination is unix socket. Make a custom transport
+		// which routes any requests into this socket via
+		// custom dialer, construct fake destination url from
+		// source domain itself
+		dst, err := url.Parse("http://" + host)
 		if err != nil {
 			return nil, err
 		}
-		rp.buckets[k] = make(chan struct{}, conf.MaxConnsPerBackend)
 		p := httputil.NewSingleHostReverseProxy(dst)
-		p.Transport = transport
-		rp.backends[k] = p
+		p.Transport = &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", backend)
+			},
+			IdleConnTimeout: 90 * time.Second,
+		}
+		return p, nil
 	}
-	return rp, nil
+	// treat destination as tcp
+	dst, err := url.Parse(backend)
+	if err != nil {
+		return nil, err
+	}
+	p := httputil.NewSingleHostReverseProxy(dst)
+	p.Transport = transport
+	return p, nil
 }
 
 func readConfig(name string) (Config, error) {
@@ -133,13 +532,290 @@ func readConfig(name string) (Config, error) {
 	if err := dec.Decode(&conf); err != nil {
 		return Config{}, err
 	}
+	if len(conf.Include) == 0 {
+		return conf, nil
+	}
+	if err := resolveIncludes(&conf, name); err != nil {
+		return Config{}, err
+	}
 	return conf, nil
 }
 
 type Config struct {
 	MaxConnsPerBackend      int
 	MaxKeepalivesPerBackend int
-	Mapping                 map[string]string
+	Mapping                 map[string]Route
+
+	// Include is a list of glob patterns of files with additional
+	// mappings, see resolveIncludes
+	Include []string `json:",omitempty"`
+
+	// Certificates are used by TLS listener; they are re-read from disk
+	// on SIGHUP
+	Certificates []KeyPair `json:",omitempty"`
+
+	// NextProtos is a list of ALPN protocols supported by TLS listener in
+	// order of preference, "h2" and "http/1.1" by default. HTTP/2 is only
+	// enabled if "h2" is in the list.
+	NextProtos []string `json:",omitempty"`
+
+	// SocketBuffers sets kernel buffer sizes of client connections
+	SocketBuffers *SocketBuffers `json:",omitempty"`
+
+	// HTTP2 tunes HTTP/2 server
+	HTTP2 *HTTP2Config `json:",omitempty"`
+
+	// ConnIdleTimeout, if set, closes client connections that neither
+	// send nor receive any data for that long while not serving a
+	// request, including connections that never sent one
+	ConnIdleTimeout Duration `json:",omitempty"`
+
+	// SessionTicketKeyRotation, if set, enables periodic rotation of
+	// TLS session ticket keys with given interval, i.e. "12h"
+	SessionTicketKeyRotation Duration `json:",omitempty"`
+
+	// TrustedProxies is a list of IP addresses or CIDR networks of
+	// proxies whose forwarding headers are trusted: their Forwarded header
+	// is used to find client address, X-Forwarded-Proto to find whether
+	// request was originally sent over https, and X-Forwarded-For is
+	// extended, or started with client address from Forwarded header if
+	// proxy didn't set it. X-Forwarded-For from other clients is replaced
+	// with their address, unless KeepUntrustedForwardedFor is set.
+	TrustedProxies []string `json:",omitempty"`
+
+	// ForwardProxy is an url of proxy used to reach backends, i.e.
+	// "http://proxy.example.com:3128" or "socks5://127.0.0.1:1080".
+	// HTTPS backends are reached through CONNECT tunnel. If not set,
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are
+	// used. It doesn't apply to unix socket backends.
+	ForwardProxy string `json:",omitempty"`
+
+	// KeepUntrustedForwardedFor makes X-Forwarded-For header extended
+	// regardless of whether client is a trusted proxy
+	KeepUntrustedForwardedFor bool `json:",omitempty"`
+
+	// DefaultHost is a Mapping key used to serve HTTP/1.0 requests without
+	// Host header. If not set, such requests are rejected with 400 status.
+	// HTTP/1.1 and later requests without Host are always rejected.
+	DefaultHost string `json:",omitempty"`
+
+	// AccessLog enables logging of served requests
+	AccessLog *AccessLogConfig `json:",omitempty"`
+
+	// NormalizePaths enables cleaning of request paths before they are
+	// processed: duplicate slashes are collapsed, "." and ".." segments
+	// resolved. Requests with paths leading above the root are rejected
+	// with 400 status.
+	NormalizePaths bool `json:",omitempty"`
+
+	// Cookies limits size and number of request cookies; limits apply
+	// even if not configured, see CookieLimits
+	Cookies *CookieLimits `json:",omitempty"`
+
+	// StaticPaths maps request paths to responses served by proxy itself
+	// for GET and HEAD requests to every host in Mapping, i.e.
+	// "/robots.txt"; requests for unknown hosts are still rejected. Route
+	// StaticPaths take precedence over these.
+	StaticPaths map[string]StaticResponse `json:",omitempty"`
+
+	// RejectMisdirected makes requests received over TLS for hosts not
+	// covered by connection certificate rejected with 421 status, so
+	// that HTTP/2 clients that coalesced connections for several hosts
+	// retry on a new one
+	RejectMisdirected bool `json:",omitempty"`
+
+	// MaxRequestsPerConn, if set, limits number of requests served at the
+	// same time over a single client connection, which matters for HTTP/2
+	// where every stream is a separate request. Requests over the limit
+	// are rejected with 503 status and Retry-After header.
+	MaxRequestsPerConn int `json:",omitempty"`
+
+	// CheckUnixSockets, if set, makes startup and reload fail if unix
+	// socket backends are misconfigured: "exist" checks that each path is
+	// an existing socket, "dial" also makes a test connection to it. By
+	// default no checks are made, since sockets may be created after
+	// proxy is started.
+	CheckUnixSockets string `json:",omitempty"`
+}
+
+// Route describes backend for a single host. In configuration file it can be
+// given either as a string holding backend url or unix socket path, or as an
+// object with Backend field and optional per-host settings.
+type Route struct {
+	Backend string
+
+	// PreserveHeaderCase lists header names that should be sent to
+	// backend exactly as written here instead of in their canonical form
+	// (i.e. "X-API-KEY" instead of "X-Api-Key"). This is only a
+	// workaround for backends that treat header names as case-sensitive:
+	// it has effect on HTTP/1.x connections only, and header order on the
+	// wire is still decided by net/http, which sorts headers by name.
+	PreserveHeaderCase []string `json:",omitempty"`
+
+	// Forwarded enables adding RFC 7239 Forwarded header to requests sent
+	// to backend. Forwarded header received from a trusted proxy is
+	// extended, from any other client it is replaced. X-Forwarded-For
+	// and X-Forwarded-Proto headers are set regardless of this setting.
+	Forwarded bool `json:",omitempty"`
+
+	// Streaming configures separate concurrency limit for long-lived
+	// requests, so that they don't take slots from regular ones
+	Streaming *StreamingConfig `json:",omitempty"`
+
+	// EmptyResponse configures handling of backend closing connection
+	// without sending any response
+	EmptyResponse *EmptyResponseConfig `json:",omitempty"`
+
+	// Gunzip enables decompression of gzip-encoded request bodies before
+	// passing them to backend
+	Gunzip *GunzipConfig `json:",omitempty"`
+
+	// HTTPSOnly disables proxying of requests received over plain HTTP;
+	// it also applies to Responses and StaticPaths
+	HTTPSOnly *HTTPSOnlyConfig `json:",omitempty"`
+
+	// Rewrite is a list of path rewrite rules; only the first matching
+	// rule is applied
+	Rewrite []RewriteRule `json:",omitempty"`
+
+	// MaxConnLifetime, if set, limits how long connections to backend
+	// are reused, i.e. "10m"
+	MaxConnLifetime Duration `json:",omitempty"`
+
+	// Timeout, if set, limits time backend may take to respond with
+	// headers, counting from the moment request is received. Once it is
+	// exceeded, client receives 504 status. Response body is not limited,
+	// so long event streams are not cut.
+	Timeout Duration `json:",omitempty"`
+
+	// TimeoutHeader configures header telling backend how much of
+	// Timeout is left
+	TimeoutHeader *TimeoutHeaderConfig `json:",omitempty"`
+
+	// AllowedUpgrades, if not empty, lists protocols (i.e. "websocket")
+	// that clients may switch to using Upgrade header; other upgrade
+	// requests are rejected with 400 status
+	AllowedUpgrades []string `json:",omitempty"`
+
+	// CSP enables Content-Security-Policy response header with
+	// per-response nonce
+	CSP *CSPConfig `json:",omitempty"`
+
+	// AllowTrace enables forwarding of TRACE requests, which are
+	// otherwise rejected with 405 status
+	AllowTrace bool `json:",omitempty"`
+
+	// ForwardProxy is an url of proxy used to reach backend, overriding
+	// global ForwardProxy; see Config.ForwardProxy
+	ForwardProxy string `json:",omitempty"`
+
+	// UpstreamSNI is a server name sent to https backend in TLS handshake
+	// and used to verify its certificate, when it differs from backend
+	// url host, i.e. if backend is given by IP address. Backend
+	// certificate is always verified, there's no way to skip it.
+	UpstreamSNI string `json:",omitempty"`
+
+	// LatencyObjective, if set, is a target time to serve requests,
+	// including time spent waiting for backend. Requests taking longer
+	// are counted as objective violations in stats.
+	LatencyObjective Duration `json:",omitempty"`
+
+	// Deprecation adds headers announcing deprecation of API served by
+	// this host
+	Deprecation *DeprecationConfig `json:",omitempty"`
+
+	// APIKey makes proxy reject requests without valid key. Responses
+	// and StaticPaths are served regardless of it.
+	APIKey *APIKeyConfig `json:",omitempty"`
+
+	// Responses are rules making proxy respond to matching requests by
+	// itself; the first matching rule is used. They are checked before
+	// StaticPaths.
+	Responses []ResponseRule `json:",omitempty"`
+
+	// StaticPaths are served for this host in addition to, or instead
+	// of global ones; see Config.StaticPaths
+	StaticPaths map[string]StaticResponse `json:",omitempty"`
+
+	// Compress enables gzip compression of responses
+	Compress *CompressConfig `json:",omitempty"`
+}
+
+func (r *Route) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		r.Backend = s
+		return nil
+	}
+	type route Route // to avoid recursion
+	return json.Unmarshal(b, (*route)(r))
+}
+
+// transport wraps base RoundTripper according to route settings
+func (r Route) transport(base http.RoundTripper) http.RoundTripper {
+	if t, ok := base.(*http.Transport); ok && r.MaxConnLifetime > 0 {
+		base = withConnLifetime(t, time.Duration(r.MaxConnLifetime))
+	}
+	if len(r.PreserveHeaderCase) != 0 {
+		base = headerCaseTransport{RoundTripper: base, names: r.PreserveHeaderCase}
+	}
+	if c := r.EmptyResponse; c != nil && (c.Retry || len(c.RetryRequests) != 0) {
+		base = retryEmptyTransport{RoundTripper: base, conf: r.EmptyResponse}
+	}
+	return base
+}
+
+// headerCaseTransport renames canonical header keys of outgoing requests to
+// their configured spelling right before request is written to the wire, so
+// it also applies to headers added by httputil.ReverseProxy itself.
+type headerCaseTransport struct {
+	http.RoundTripper
+	names []string
+}
+
+func (t headerCaseTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Header = r.Header.Clone()
+	for _, name := range t.names {
+		key := http.CanonicalHeaderKey(name)
+		if key == name {
+			continue
+		}
+		if v, ok := r2.Header[key]; ok {
+			delete(r2.Header, key)
+			r2.Header[name] = v
+		}
+	}
+	return t.RoundTripper.RoundTrip(r2)
+}
+
+// Duration is a time.Duration represented in configuration file as a string
+// accepted by time.ParseDuration
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (c Config) nextProtos() []string {
+	if len(c.NextProtos) == 0 {
+		return []string{"h2", "http/1.1"}
+	}
+	return c.NextProtos
 }
 
 func (c Config) validate() error {
@@ -149,25 +825,242 @@ func (c Config) validate() error {
 	if c.MaxKeepalivesPerBackend < 1 {
 		return errors.New("MaxKeepalivesPerBackend is too low")
 	}
+	if c.ConnIdleTimeout < 0 {
+		return errors.New("ConnIdleTimeout should not be negative")
+	}
+	if c.MaxRequestsPerConn < 0 {
+		return errors.New("MaxRequestsPerConn should not be negative")
+	}
+	if c.SessionTicketKeyRotation < 0 {
+		return errors.New("SessionTicketKeyRotation should not be negative")
+	}
+	if err := c.AccessLog.validate(); err != nil {
+		return err
+	}
+	if c.ForwardProxy != "" {
+		if _, err := parseForwardProxy(c.ForwardProxy); err != nil {
+			return err
+		}
+	}
+	if err := c.Cookies.validate(); err != nil {
+		return err
+	}
+	if err := c.SocketBuffers.validate(); err != nil {
+		return err
+	}
+	if err := c.HTTP2.validate(); err != nil {
+		return err
+	}
+	if err := validSocketCheck(c.CheckUnixSockets); err != nil {
+		return err
+	}
+	if err := validateStaticPaths(c.StaticPaths); err != nil {
+		return err
+	}
+	for _, p := range c.NextProtos {
+		if p == "" {
+			return errors.New("NextProtos should not contain empty values")
+		}
+	}
 	if len(c.Mapping) == 0 {
 		return errors.New("no backends provided")
 	}
+	if _, ok := c.Mapping[c.DefaultHost]; c.DefaultHost != "" && !ok {
+		return fmt.Errorf("DefaultHost %q is not in Mapping", c.DefaultHost)
+	}
+	for k, v := range c.Mapping {
+		if err := v.validate(); err != nil {
+			return fmt.Errorf("%s: %v", k, err)
+		}
+	}
+	return c.checkUnixSockets()
+}
+
+func (r Route) validate() error {
+	if r.Backend == "" {
+		return errors.New("no backend set")
+	}
+	if r.ForwardProxy != "" {
+		if strings.HasPrefix(r.Backend, "/") {
+			return errors.New("ForwardProxy can't be used with unix socket backend")
+		}
+		if _, err := parseForwardProxy(r.ForwardProxy); err != nil {
+			return err
+		}
+	}
+	if r.UpstreamSNI != "" {
+		if !strings.HasPrefix(r.Backend, "https://") {
+			return errors.New("UpstreamSNI can only be used with https backend")
+		}
+		if !isHostname(r.UpstreamSNI) {
+			return fmt.Errorf("UpstreamSNI %q is not a valid hostname", r.UpstreamSNI)
+		}
+	}
+	if err := r.Streaming.validate(); err != nil {
+		return err
+	}
+	if err := r.EmptyResponse.validate(); err != nil {
+		return err
+	}
+	if err := r.Gunzip.validate(); err != nil {
+		return err
+	}
+	if err := r.HTTPSOnly.validate(); err != nil {
+		return err
+	}
+	if _, err := compileRewrites(r.Rewrite); err != nil {
+		return err
+	}
+	if r.MaxConnLifetime < 0 {
+		return errors.New("MaxConnLifetime should not be negative")
+	}
+	if r.Timeout < 0 {
+		return errors.New("Timeout should not be negative")
+	}
+	if r.LatencyObjective < 0 {
+		return errors.New("LatencyObjective should not be negative")
+	}
+	if err := r.TimeoutHeader.validate(); err != nil {
+		return err
+	}
+	if err := r.CSP.validate(); err != nil {
+		return err
+	}
+	if err := r.Compress.validate(); err != nil {
+		return err
+	}
+	if err := validateStaticPaths(r.StaticPaths); err != nil {
+		return err
+	}
+	for _, rule := range r.Responses {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+	if err := r.APIKey.validate(); err != nil {
+		return err
+	}
+	if err := r.Deprecation.validate(); err != nil {
+		return err
+	}
 	return nil
 }
 
 func (rp *RevProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	p, ok := rp.backends[r.Host]
+	t := rp.table.Load()
+	t.inflight.Add(1)
+	defer t.inflight.Add(-1)
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	w = sw
+	if t.accessLog != nil {
+		defer func() { t.accessLog.log(t, r, sw.status, time.Since(start)) }()
+	}
+	// net/http rejects repeated Host in HTTP/1 requests, but in HTTP/2
+	// Host header is kept alongside :authority pseudo-header
+	if hosts := r.Header.Values("Host"); len(hosts) > 1 ||
+		len(hosts) == 1 && !strings.EqualFold(hosts[0], r.Host) {
+		rp.conflictingHost.Add(1)
+		log.Printf("%s request from %s with conflicting Host %q and authority %q rejected",
+			r.Proto, r.RemoteAddr, hosts, r.Host)
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	host := r.Host
+	if host == "" {
+		if t.defaultHost == "" || r.ProtoAtLeast(1, 1) {
+			rp.missingHost.Add(1)
+			log.Printf("%s request from %s without Host header rejected", r.Proto, r.RemoteAddr)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		host = t.defaultHost
+		r.Host = host
+	}
+	if t.rejectMisdirected && misdirected(r) {
+		http.Error(w, "Misdirected Request", http.StatusMisdirectedRequest)
+		return
+	}
+	if t.maxConnRequests > 0 {
+		release, ok := acquireConnSlot(r.Context(), t.maxConnRequests)
+		if !ok {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
+	}
+	if t.normalize && !normalizeURL(r.URL) {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if !t.cookies.check(r) {
+		http.Error(w, http.StatusText(t.cookies.Status), t.cookies.Status)
+		return
+	}
+	b, ok := t.backends[host]
 	if !ok {
 		http.Error(w, "Bad Gateway", http.StatusBadGateway)
 		return
 	}
-	bkt := rp.buckets[r.Host]
-	select {
-	case bkt <- struct{}{}:
-		defer func() { <-bkt }()
-		p.ServeHTTP(w, r)
-	default:
+	if c := b.route.HTTPSOnly; c != nil && t.scheme(r) != "https" {
+		c.refuse(w, r)
+		return
+	}
+	for _, rule := range b.responses {
+		if rule.match(r) {
+			rule.content.serve(w, r)
+			return
+		}
+	}
+	if c := b.static[r.URL.Path]; c != nil && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		c.serve(w, r)
+		return
+	}
+	defer func() {
+		b.stats.record(sw.status, time.Since(start), time.Duration(b.route.LatencyObjective))
+	}()
+	if d := time.Duration(b.route.Timeout); d > 0 {
+		var cancel func()
+		r, cancel = withResponseTimeout(r, start.Add(d))
+		defer cancel()
+	}
+	if k := b.apiKeys; k != nil {
+		if !k.check(r) {
+			http.Error(w, http.StatusText(k.status), k.status)
+			return
+		}
+		if k.strip {
+			r.Header.Del(k.header)
+		}
+	}
+	if r.Method == http.MethodTrace && !b.route.AllowTrace {
+		w.Header().Set("Allow", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(b.route.AllowedUpgrades) != 0 && isUpgrade(r) &&
+		!upgradeAllowed(r, b.route.AllowedUpgrades) {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	bkt := b.bucket
+	if b.streamC != nil && b.streamC.matchRequest(r) {
+		bkt = b.stream
+	}
+	if !bkt.tryAcquire() {
 		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
 		return
 	}
+	conc := bkt.len()
+	defer func() { b.stats.recordConcurrency(conc, time.Since(start)) }()
+	s := &slot{bucket: bkt}
+	defer s.release()
+	if b.streamC != nil {
+		r = r.WithContext(context.WithValue(r.Context(), slotKey{}, s))
+	}
+	if c := b.route.EmptyResponse; c != nil && r.Body != http.NoBody && c.retryBody(r) {
+		r = r.WithContext(context.WithValue(r.Context(), retryBodyKey{}, true))
+	}
+	b.proxy.ServeHTTP(w, r)
 }
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// newTestProxy returns proxy for routes with limits high enough for tests
+func newTestProxy(t *testing.T, routes map[string]Route) *RevProxy {
+	t.Helper()
+	return newTestProxyConf(t, Config{Mapping: routes})
+}
+
+// newTestProxyConf is like newTestProxy, but allows to set other options;
+// zero connection limits are set to defaults suitable for tests
+func newTestProxyConf(t *testing.T, conf Config) *RevProxy {
+	t.Helper()
+	if conf.MaxConnsPerBackend == 0 {
+		conf.MaxConnsPerBackend = 100
+	}
+	if conf.MaxKeepalivesPerBackend == 0 {
+		conf.MaxKeepalivesPerBackend = 10
+	}
+	rp, err := NewRevProxy(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rp
+}
+
+// serve passes request to h and returns recorded response
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestTrace(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Method))
+	}))
+	defer backend.Close()
+	rp := newTestProxy(t, map[string]Route{
+		"a": {Backend: backend.URL},
+		"b": {Backend: backend.URL, AllowTrace: true},
+	})
+	w := serve(rp, httptest.NewRequest("TRACE", "http://a/", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") == "" {
+		t.Errorf("TRACE by default: got %d, Allow %q; want 405 with Allow header", w.Code, w.Header().Get("Allow"))
+	}
+	if w := serve(rp, httptest.NewRequest("TRACE", "http://b/", nil)); w.Code != 200 || w.Body.String() != "TRACE" {
+		t.Errorf("TRACE with AllowTrace: got %d %q, want it forwarded", w.Code, w.Body.String())
+	}
+	if w := serve(rp, httptest.NewRequest("GET", "http://a/", nil)); w.Code != 200 || w.Body.String() != "GET" {
+		t.Errorf("GET: got %d %q, want it forwarded", w.Code, w.Body.String())
+	}
+}
+
+func TestUpstreamSNI(t *testing.T) {
+	pair := writeKeyPair(t, t.TempDir(), "backend", "backend.example")
+	cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.ServerName))
+	}))
+	backend.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	backend.StartTLS()
+	defer backend.Close()
+	if !strings.HasPrefix(backend.URL, "https://127.0.0.1:") {
+		t.Fatalf("backend is not reachable by IP address: %s", backend.URL)
+	}
+	certPEM, err := os.ReadFile(pair.CertFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(certPEM)
+
+	conf := Config{
+		MaxConnsPerBackend:      100,
+		MaxKeepalivesPerBackend: 10,
+		Mapping: map[string]Route{
+			"sni":   {Backend: backend.URL, UpstreamSNI: "backend.example"},
+			"wrong": {Backend: backend.URL, UpstreamSNI: "other.example"},
+			"ip":    {Backend: backend.URL},
+		},
+	}
+	rp := newTestProxyConf(t, conf)
+	// trust backend certificate; per-route transports are cloned from the
+	// shared one on reload
+	rp.transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	if err := rp.Reload(conf); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(rp, httptest.NewRequest("GET", "http://sni/", nil)); w.Code != 200 || w.Body.String() != "backend.example" {
+		t.Errorf("with UpstreamSNI backend got %d, server name %q", w.Code, w.Body.String())
+	}
+	// certificate is verified against UpstreamSNI, not the IP address
+	if w := serve(rp, httptest.NewRequest("GET", "http://wrong/", nil)); w.Code != http.StatusBadGateway {
+		t.Errorf("with mismatching UpstreamSNI got %d, want 502", w.Code)
+	}
+	if w := serve(rp, httptest.NewRequest("GET", "http://ip/", nil)); w.Code != http.StatusBadGateway {
+		t.Errorf("without UpstreamSNI got %d, want 502", w.Code)
+	}
+}
+
+// unixBackend starts server on unix socket in dir, returning socket path and
+// number of its open connections
+func unixBackend(t *testing.T, dir, name string, h http.Handler) (string, *atomic.Int64) {
+	t.Helper()
+	sock := filepath.Join(dir, name)
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := new(atomic.Int64)
+	srv := &http.Server{Handler: h, ConnState: func(_ net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			open.Add(1)
+		case http.StateClosed, http.StateHijacked:
+			open.Add(-1)
+		}
+	}}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return sock, open
+}
+
+func TestReloadUnderLoad(t *testing.T) {
+	dir := t.TempDir()
+	handler := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(20 * time.Millisecond)
+			io.WriteString(w, name)
+		})
+	}
+	sockA, _ := unixBackend(t, dir, "a.sock", handler("a"))
+	sockB, openB := unixBackend(t, dir, "b.sock", handler("b"))
+	conf := func(sock string) Config {
+		return Config{
+			MaxConnsPerBackend:      100,
+			MaxKeepalivesPerBackend: 10,
+			Mapping:                 map[string]Route{"host": {Backend: sock}},
+		}
+	}
+	rp := newTestProxyConf(t, conf(sockA))
+	front := httptest.NewServer(rp)
+	defer front.Close()
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 20}}
+	defer client.CloseIdleConnections()
+
+	var wg sync.WaitGroup
+	var requests, failures atomic.Int64
+	stop := make(chan struct{})
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				req, err := http.NewRequest("GET", front.URL, nil)
+				if err != nil {
+					panic(err)
+				}
+				req.Host = "host"
+				requests.Add(1)
+				resp, err := client.Do(req)
+				if err != nil {
+					failures.Add(1)
+					continue
+				}
+				b, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil || resp.StatusCode != 200 || (string(b) != "a" && string(b) != "b") {
+					failures.Add(1)
+				}
+			}
+		}()
+	}
+	// switch host between backends while requests are in flight
+	for i := 0; i < 20; i++ {
+		time.Sleep(10 * time.Millisecond)
+		sock := sockA
+		if i%2 == 0 {
+			sock = sockB
+		}
+		if err := rp.Reload(conf(sock)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	if n := failures.Load(); n != 0 {
+		t.Fatalf("%d of %d requests failed", n, requests.Load())
+	}
+	if w := serve(rp, httptest.NewRequest("GET", "http://host/", nil)); w.Body.String() != "a" {
+		t.Fatalf("after the last reload got response from %q, want a", w.Body.String())
+	}
+	// connections to backend no longer in use are closed once tables using
+	// it are drained
+	for deadline := time.Now().Add(2 * time.Second); openB.Load() != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections to removed backend are still open", openB.Load())
+		}
+	}
+}
+
+func TestConflictingHost(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	rp := newTestProxy(t, map[string]Route{"a.example": {Backend: backend.URL}})
+
+	// HTTP/2 requests keep Host header along with :authority
+	for _, tc := range []struct {
+		hosts  []string
+		status int
+	}{
+		{nil, 200},
+		{[]string{"A.example"}, 200},
+		{[]string{"b.example"}, 400},
+		{[]string{"a.example", "b.example"}, 400},
+	} {
+		r := httptest.NewRequest("GET", "http://a.example/", nil)
+		r.Header["Host"] = tc.hosts
+		if w := serve(rp, r); w.Code != tc.status {
+			t.Errorf("Host %q with authority a.example: got %d, want %d", tc.hosts, w.Code, tc.status)
+		}
+	}
+	if n := rp.conflictingHost.Load(); n != 2 {
+		t.Errorf("%d requests counted as having conflicting Host, want 2", n)
+	}
+
+	srv := httptest.NewUnstartedServer(rp)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	t.Run("HTTP/1 duplicate Host", func(t *testing.T) {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		tc := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		tc.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(tc, "GET / HTTP/1.1\r\nHost: a.example\r\nHost: b.example\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(tc), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 400 {
+			t.Errorf("got status %d, want 400", resp.StatusCode)
+		}
+	})
+
+	t.Run("HTTP/2 Host conflicting with authority", func(t *testing.T) {
+		for _, tc := range []struct {
+			host   string
+			status string
+		}{
+			{"a.example", "200"},
+			{"b.example", "400"},
+		} {
+			if got := h2Status(t, srv.Listener.Addr().String(), "a.example", tc.host); got != tc.status {
+				t.Errorf("Host %q: got status %s, want %s", tc.host, got, tc.status)
+			}
+		}
+	})
+}
+
+// h2Status sends HTTP/2 GET request with given :authority and Host header
+// to TLS server at addr using raw frames, as http.Transport doesn't send
+// Host header over HTTP/2, and returns response status
+func h2Status(t *testing.T, addr, authority, host string) string {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, http2.ClientPreface); err != nil {
+		t.Fatal(err)
+	}
+	fr := http2.NewFramer(conn, conn)
+	fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	if err := fr.WriteSettings(); err != nil {
+		t.Fatal(err)
+	}
+	var block bytes.Buffer
+	enc := hpack.NewEncoder(&block)
+	for _, f := range [][2]string{
+		{":method", "GET"}, {":scheme", "https"}, {":authority", authority}, {":path", "/"}, {"host", host},
+	} {
+		enc.WriteField(hpack.HeaderField{Name: f[0], Value: f[1]})
+	}
+	if err := fr.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: block.Bytes(),
+		EndStream:     true,
+		EndHeaders:    true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				fr.WriteSettingsAck()
+			}
+		case *http2.MetaHeadersFrame:
+			return f.PseudoValue("status")
+		}
+	}
+}
+
+// TestConditionalRequest ensures validators reach backend unchanged and its
+// 304 response is passed to client without body
+func TestConditionalRequest(t *testing.T) {
+	const modified = "Wed, 07 Oct 2026 10:00:00 GMT"
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Got-If-None-Match", r.Header.Get("If-None-Match"))
+		w.Header().Set("Got-If-Modified-Since", r.Header.Get("If-Modified-Since"))
+		w.Header().Set("Etag", `"v1"`)
+		w.Header().Set("Last-Modified", modified)
+		// weak comparison, as required for If-None-Match
+		if inm := r.Header.Get("If-None-Match"); strings.TrimPrefix(inm, "W/") == `"v1"` ||
+			inm == "" && r.Header.Get("If-Modified-Since") == modified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, strings.Repeat("hello\n", 1000))
+	}))
+	defer backend.Close()
+	rp := newTestProxy(t, map[string]Route{
+		"a": {Backend: backend.URL},
+		"b": {Backend: backend.URL, Compress: &CompressConfig{}},
+	})
+	for _, tc := range []struct {
+		host, inm, ims string
+		status         int
+		etag           string
+	}{
+		{"a", `"v1"`, "", 304, `"v1"`},
+		{"a", "", modified, 304, `"v1"`},
+		{"a", `"v1"`, modified, 304, `"v1"`},
+		{"a", `"v0"`, modified, 200, `"v1"`},
+		// compressed response carries weak Etag, which client sends back
+		{"b", `W/"v1"`, "", 304, `W/"v1"`},
+		{"b", "", modified, 304, `W/"v1"`},
+		{"b", `"v0"`, "", 200, `W/"v1"`},
+	} {
+		r := httptest.NewRequest("GET", "http://"+tc.host+"/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		if tc.inm != "" {
+			r.Header.Set("If-None-Match", tc.inm)
+		}
+		if tc.ims != "" {
+			r.Header.Set("If-Modified-Since", tc.ims)
+		}
+		w := serve(rp, r)
+		h := w.Header()
+		if got := h.Get("Got-If-None-Match"); got != tc.inm {
+			t.Errorf("%s, If-None-Match %q: backend got %q", tc.host, tc.inm, got)
+		}
+		if got := h.Get("Got-If-Modified-Since"); got != tc.ims {
+			t.Errorf("%s, If-Modified-Since %q: backend got %q", tc.host, tc.ims, got)
+		}
+		if w.Code != tc.status {
+			t.Errorf("%s, If-None-Match %q, If-Modified-Since %q: got status %d, want %d",
+				tc.host, tc.inm, tc.ims, w.Code, tc.status)
+			continue
+		}
+		if tc.status == 304 && w.Body.Len() != 0 {
+			t.Errorf("%s: 304 response has %d bytes of body", tc.host, w.Body.Len())
+		}
+		if tc.status == 200 && w.Body.Len() == 0 {
+			t.Errorf("%s: 200 response has no body", tc.host)
+		}
+		if got := h.Get("Etag"); got != tc.etag {
+			t.Errorf("%s, status %d: got Etag %q, want %q", tc.host, w.Code, got, tc.etag)
+		}
+		if got := h.Get("Last-Modified"); got != modified {
+			t.Errorf("%s, status %d: got Last-Modified %q", tc.host, w.Code, got)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RewriteRule describes regular expression substitution applied to request
+// path before it is sent to backend. Pattern is matched against escaped
+// path (as it was sent by client) and its first match is replaced with
+// Replace, which may refer to capture groups as $1 or ${name}, see
+// regexp.Regexp.Expand. If result contains "?", part after it is prepended
+// to request query. Expressions use RE2 syntax, so their matching time is
+// linear in the size of input.
+type RewriteRule struct {
+	Pattern string
+	Replace string
+}
+
+type rewriteRule struct {
+	re      *regexp.Regexp
+	replace string
+}
+
+// rewriter applies the first matching rule to url
+type rewriter []rewriteRule
+
+func compileRewrites(rules []RewriteRule) (rewriter, error) {
+	var out rewriter
+	for _, rule := range rules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkTemplate(re, rule.Replace); err != nil {
+			return nil, fmt.Errorf("rewrite %q: %v", rule.Pattern, err)
+		}
+		out = append(out, rewriteRule{re: re, replace: rule.Replace})
+	}
+	return out, nil
+}
+
+// checkTemplate verifies that every $ reference in tpl refers to existing
+// capture group of re
+func checkTemplate(re *regexp.Regexp, tpl string) error {
+	for i := 0; i < len(tpl); i++ {
+		if tpl[i] != '$' {
+			continue
+		}
+		if i++; i == len(tpl) {
+			return fmt.Errorf("dangling $ in %q", tpl)
+		}
+		var name string
+		switch tpl[i] {
+		case '$':
+			continue
+		case '{':
+			j := strings.IndexByte(tpl[i:], '}')
+			if j < 0 {
+				return fmt.Errorf("unterminated ${ in %q", tpl)
+			}
+			name, i = tpl[i+1:i+j], i+j
+		default:
+			j := i
+			for j < len(tpl) && isNameChar(tpl[j]) {
+				j++
+			}
+			name, i = tpl[i:j], j-1
+		}
+		if name == "" {
+			return fmt.Errorf("invalid $ reference in %q", tpl)
+		}
+		if n, err := strconv.Atoi(name); err == nil {
+			if n > re.NumSubexp() {
+				return fmt.Errorf("reference to missing group $%d", n)
+			}
+			continue
+		}
+		if re.SubexpIndex(name) < 0 {
+			return fmt.Errorf("reference to missing group %q", name)
+		}
+	}
+	return nil
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+func (rw rewriter) rewrite(u *url.URL) {
+	src := u.EscapedPath()
+	for _, rule := range rw {
+		m := rule.re.FindStringSubmatchIndex(src)
+		if m == nil {
+			continue
+		}
+		dst := src[:m[0]] + string(rule.re.ExpandString(nil, rule.replace, src, m)) + src[m[1]:]
+		var query string
+		if i := strings.IndexByte(dst, '?'); i >= 0 {
+			dst, query = dst[:i], dst[i+1:]
+		}
+		p, err := url.PathUnescape(dst)
+		if err != nil {
+			log.Printf("rewrite of %q with %q: %v", src, rule.re, err)
+			return
+		}
+		if !strings.HasPrefix(p, "/") {
+			p, dst = "/"+p, "/"+dst
+		}
+		u.Path, u.RawPath = p, dst
+		switch {
+		case query == "":
+		case u.RawQuery == "":
+			u.RawQuery = query
+		default:
+			u.RawQuery = query + "&" + u.RawQuery
+		}
+		return
+	}
+}
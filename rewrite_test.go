@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestRewrite(t *testing.T) {
+	rw, err := compileRewrites([]RewriteRule{
+		{Pattern: `^/api/v1/(?P<rest>.*)$`, Replace: `/v1/${rest}`},
+		{Pattern: `^/users/([0-9]+)$`, Replace: `/user?id=$1`},
+		{Pattern: `^/files/(.*)$`, Replace: `/storage/$1`},
+		{Pattern: `/x/`, Replace: `/y/`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		in, path, escaped, query string
+	}{
+		// named capture group
+		{"/api/v1/items/7", "/v1/items/7", "/v1/items/7", ""},
+		// generated query is prepended to the one sent by client
+		{"/users/42", "/user", "/user", "id=42"},
+		{"/users/42?sort=asc", "/user", "/user", "id=42&sort=asc"},
+		// pattern is matched against escaped path, which is kept
+		{"/files/a%2Fb%20c", "/storage/a/b c", "/storage/a%2Fb%20c", ""},
+		// only the first match is replaced
+		{"/a/x/b/x/c", "/a/y/b/x/c", "/a/y/b/x/c", ""},
+		// no rule matches
+		{"/other", "/other", "/other", ""},
+	} {
+		u, err := url.Parse(tc.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rw.rewrite(u)
+		if u.Path != tc.path || u.EscapedPath() != tc.escaped || u.RawQuery != tc.query {
+			t.Errorf("%s: got path %q, escaped %q, query %q; want %q, %q, %q",
+				tc.in, u.Path, u.EscapedPath(), u.RawQuery, tc.path, tc.escaped, tc.query)
+		}
+	}
+}
+
+func TestRewriteInvalidTemplate(t *testing.T) {
+	for _, rule := range []RewriteRule{
+		{Pattern: `^/(a)$`, Replace: `/$2`},
+		{Pattern: `^/(?P<x>a)$`, Replace: `/${y}`},
+		{Pattern: `^/a$`, Replace: `/$`},
+	} {
+		if _, err := compileRewrites([]RewriteRule{rule}); err == nil {
+			t.Errorf("%q -> %q: no error", rule.Pattern, rule.Replace)
+		}
+	}
+}
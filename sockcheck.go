@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Values of Config.CheckUnixSockets
+const (
+	checkSocketsExist = "exist"
+	checkSocketsDial  = "dial"
+)
+
+// socketDialTimeout limits test connection made by CheckUnixSockets "dial"
+const socketDialTimeout = time.Second
+
+func validSocketCheck(mode string) error {
+	switch mode {
+	case "", checkSocketsExist, checkSocketsDial:
+		return nil
+	}
+	return fmt.Errorf("unsupported CheckUnixSockets value %q", mode)
+}
+
+// checkUnixSockets verifies that unix socket backends exist according to
+// CheckUnixSockets mode. Error names the first failed host, in sorted order.
+func (c Config) checkUnixSockets() error {
+	if c.CheckUnixSockets == "" {
+		return nil
+	}
+	hosts := make([]string, 0, len(c.Mapping))
+	for k := range c.Mapping {
+		hosts = append(hosts, k)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		name := c.Mapping[host].Backend
+		if !strings.HasPrefix(name, "/") {
+			continue
+		}
+		if err := checkUnixSocket(name, c.CheckUnixSockets == checkSocketsDial); err != nil {
+			return fmt.Errorf("%s: %v", host, err)
+		}
+	}
+	return nil
+}
+
+func checkUnixSocket(name string, dial bool) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s is not a socket", name)
+	}
+	if !dial {
+		return nil
+	}
+	conn, err := net.DialTimeout("unix", name, socketDialTimeout)
+	if err != nil {
+		var oe *net.OpError
+		if errors.As(err, &oe) && oe.Err != nil {
+			err = oe.Err
+		}
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return conn.Close()
+}
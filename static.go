@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StaticResponse is a fixed response served by proxy itself instead of
+// backend, i.e. for /robots.txt or /.well-known/security.txt. Body is either
+// Content or contents of File, which is read when configuration is loaded.
+type StaticResponse struct {
+	Content string `json:",omitempty"`
+	File    string `json:",omitempty"`
+	// ContentType is detected from path extension if not set
+	ContentType string `json:",omitempty"`
+}
+
+func (s StaticResponse) validate() error {
+	if s.Content != "" && s.File != "" {
+		return errors.New("only one of Content and File can be set")
+	}
+	return nil
+}
+
+// validateStaticPaths checks StaticPaths setting, which maps request paths to
+// responses
+func validateStaticPaths(m map[string]StaticResponse) error {
+	for p, s := range m {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("StaticPaths: %q should start with /", p)
+		}
+		if err := s.validate(); err != nil {
+			return fmt.Errorf("StaticPaths %s: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// ResponseRule makes proxy respond to requests with path matching Path by
+// itself, i.e. with 410 status for retired endpoint or with fixed body for
+// health check path
+type ResponseRule struct {
+	// Path is a path.Match pattern matched against request path
+	Path string
+	// Methods limits rule to requests with these methods
+	Methods []string `json:",omitempty"`
+	// Status is a response status code, 200 if zero
+	Status int `json:",omitempty"`
+	// Header holds additional response headers
+	Header map[string]string `json:",omitempty"`
+	StaticResponse
+}
+
+func (r ResponseRule) validate() error {
+	if _, err := path.Match(r.Path, ""); err != nil {
+		return fmt.Errorf("Responses %s: %w", r.Path, err)
+	}
+	if r.Status != 0 && (r.Status < 200 || r.Status > 599) {
+		return fmt.Errorf("Responses %s: invalid Status %d", r.Path, r.Status)
+	}
+	if err := r.StaticResponse.validate(); err != nil {
+		return fmt.Errorf("Responses %s: %v", r.Path, err)
+	}
+	return nil
+}
+
+// responseRule is a loaded ResponseRule
+type responseRule struct {
+	path    string
+	methods []string
+	content *staticContent
+}
+
+func loadResponseRules(rules []ResponseRule) ([]responseRule, error) {
+	out := make([]responseRule, 0, len(rules))
+	for _, r := range rules {
+		c, err := r.StaticResponse.load(r.Path)
+		if err != nil {
+			return nil, fmt.Errorf("Responses %s: %w", r.Path, err)
+		}
+		c.status = r.Status
+		if len(r.Header) != 0 {
+			c.header = make(http.Header, len(r.Header))
+			for k, v := range r.Header {
+				c.header.Set(k, v)
+			}
+		}
+		out = append(out, responseRule{path: r.Path, methods: r.Methods, content: c})
+	}
+	return out, nil
+}
+
+func (r responseRule) match(req *http.Request) bool {
+	if len(r.methods) != 0 && !slices.Contains(r.methods, req.Method) {
+		return false
+	}
+	ok, _ := path.Match(r.path, req.URL.Path)
+	return ok
+}
+
+// staticContent is a loaded StaticResponse
+type staticContent struct {
+	body        []byte
+	contentType string
+	status      int         // if not set, content is served as a file
+	header      http.Header // additional headers
+}
+
+// loadStaticPaths reads static responses, returning copy of base with them
+// added; m entries replace ones of base with the same path
+func loadStaticPaths(base map[string]*staticContent, m map[string]StaticResponse) (map[string]*staticContent, error) {
+	if len(m) == 0 {
+		return base, nil
+	}
+	out := maps.Clone(base)
+	if out == nil {
+		out = make(map[string]*staticContent, len(m))
+	}
+	for p, s := range m {
+		c, err := s.load(p)
+		if err != nil {
+			return nil, fmt.Errorf("StaticPaths %s: %w", p, err)
+		}
+		out[p] = c
+	}
+	return out, nil
+}
+
+// load reads response served for path p
+func (s StaticResponse) load(p string) (*staticContent, error) {
+	c := &staticContent{body: []byte(s.Content), contentType: s.ContentType}
+	if s.File != "" {
+		b, err := os.ReadFile(s.File)
+		if err != nil {
+			return nil, err
+		}
+		c.body = b
+	}
+	if c.contentType == "" {
+		c.contentType = mime.TypeByExtension(path.Ext(p))
+	}
+	if c.contentType == "" {
+		c.contentType = "text/plain; charset=utf-8"
+	}
+	return c, nil
+}
+
+func (c *staticContent) serve(w http.ResponseWriter, r *http.Request) {
+	for k, v := range c.header {
+		w.Header()[k] = slices.Clone(v)
+	}
+	w.Header().Set("Content-Type", c.contentType)
+	if c.status == 0 {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(c.body))
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(c.body)))
+	w.WriteHeader(c.status)
+	if r.Method != http.MethodHead {
+		w.Write(c.body)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStaticPaths(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+	rp := newTestProxyConf(t, Config{
+		StaticPaths: map[string]StaticResponse{
+			"/robots.txt":  {Content: "User-agent: *\n"},
+			"/favicon.ico": {Content: "global", ContentType: "image/x-icon"},
+		},
+		Mapping: map[string]Route{
+			"a": {Backend: backend.URL},
+			"b": {Backend: backend.URL, StaticPaths: map[string]StaticResponse{
+				"/favicon.ico": {Content: "own"},
+			}},
+		},
+	})
+	for _, tc := range []struct {
+		method, url string
+		status      int
+		body        string
+		contentType string
+	}{
+		{"GET", "http://a/robots.txt", 200, "User-agent: *\n", "text/plain; charset=utf-8"},
+		{"HEAD", "http://a/robots.txt", 200, "", "text/plain; charset=utf-8"},
+		{"POST", "http://a/robots.txt", 200, "backend", ""},
+		{"GET", "http://a/favicon.ico", 200, "global", "image/x-icon"},
+		{"GET", "http://b/favicon.ico", 200, "own", ""},
+		{"GET", "http://b/robots.txt", 200, "User-agent: *\n", "text/plain; charset=utf-8"},
+		{"GET", "http://a/other", 200, "backend", ""},
+		// global paths are only served for mapped hosts
+		{"GET", "http://unknown/robots.txt", 502, "Bad Gateway\n", ""},
+	} {
+		w := serve(rp, httptest.NewRequest(tc.method, tc.url, nil))
+		if w.Code != tc.status || w.Body.String() != tc.body {
+			t.Errorf("%s %s: got %d %q, want %d %q", tc.method, tc.url, w.Code, w.Body.String(), tc.status, tc.body)
+		}
+		if ct := w.Header().Get("Content-Type"); tc.contentType != "" && ct != tc.contentType {
+			t.Errorf("%s %s: got Content-Type %q, want %q", tc.method, tc.url, ct, tc.contentType)
+		}
+	}
+}
+
+func TestResponses(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+	responses := []ResponseRule{
+		{Path: "/v1/*", Status: http.StatusGone, StaticResponse: StaticResponse{Content: "retired"}},
+		{Path: "/healthz", Methods: []string{"GET", "HEAD"}, Header: map[string]string{"Cache-Control": "no-store"},
+			StaticResponse: StaticResponse{Content: "ok", ContentType: "text/plain"}},
+	}
+	rp := newTestProxy(t, map[string]Route{
+		"a": {Backend: backend.URL, Responses: responses},
+		"s": {Backend: backend.URL, Responses: responses, HTTPSOnly: &HTTPSOnlyConfig{},
+			StaticPaths: map[string]StaticResponse{"/robots.txt": {Content: "User-agent: *\n"}}},
+	})
+	for _, tc := range []struct {
+		method, url string
+		status      int
+		body        string
+	}{
+		{"GET", "http://a/v1/users", 410, "retired"},
+		{"DELETE", "http://a/v1/users", 410, "retired"},
+		{"GET", "http://a/v1/users/1", 200, "backend"}, // path.Match doesn't cross /
+		{"GET", "http://a/healthz", 200, "ok"},
+		{"POST", "http://a/healthz", 200, "backend"},
+		{"GET", "http://a/v2/users", 200, "backend"},
+		// plain HTTP requests to HTTPSOnly hosts are refused before
+		// proxy responds by itself
+		{"GET", "http://s/healthz", 403, "Forbidden\n"},
+		{"GET", "http://s/robots.txt", 403, "Forbidden\n"},
+		{"GET", "https://s/healthz", 200, "ok"},
+	} {
+		w := serve(rp, httptest.NewRequest(tc.method, tc.url, nil))
+		if w.Code != tc.status || w.Body.String() != tc.body {
+			t.Errorf("%s %s: got %d %q, want %d %q", tc.method, tc.url, w.Code, w.Body.String(), tc.status, tc.body)
+		}
+	}
+	w := serve(rp, httptest.NewRequest("GET", "http://a/healthz", nil))
+	if h := w.Header(); h.Get("Cache-Control") != "no-store" || h.Get("Content-Type") != "text/plain" {
+		t.Errorf("probe response has headers %v", h)
+	}
+}
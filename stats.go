@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBounds are upper bounds of latency histogram buckets; the last,
+// implicit bucket holds everything above
+var latencyBounds = [...]time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+}
+
+// histogram is a lock-free latency histogram with fixed buckets
+type histogram struct {
+	counts [len(latencyBounds) + 1]atomic.Uint64
+}
+
+// count returns number of observations
+func (h *histogram) count() uint64 {
+	var total uint64
+	for i := range h.counts {
+		total += h.counts[i].Load()
+	}
+	return total
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBounds) && d > latencyBounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+}
+
+// quantile returns approximate q-quantile (0 < q ≤ 1) as upper bound of the
+// bucket where it falls. Values in overflow bucket are reported as the last
+// bound. It returns 0 if histogram is empty.
+func (h *histogram) quantile(q float64) time.Duration {
+	var counts [len(h.counts)]uint64
+	var total uint64
+	for i := range h.counts {
+		counts[i] = h.counts[i].Load()
+		total += counts[i]
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(total) + 0.5)
+	if rank == 0 {
+		rank = 1
+	}
+	var seen uint64
+	for i, n := range counts {
+		if seen += n; seen >= rank && i < len(latencyBounds) {
+			return latencyBounds[i]
+		}
+	}
+	return latencyBounds[len(latencyBounds)-1]
+}
+
+// concurrencyBands is a number of bands requests are grouped into by
+// concurrency level observed when they were admitted: band i holds levels
+// up to 1<<i, the last one everything above
+const concurrencyBands = 12
+
+// concurrencyBand returns band for concurrency level n
+func concurrencyBand(n int) int {
+	i := 0
+	for i < concurrencyBands-1 && n > 1<<i {
+		i++
+	}
+	return i
+}
+
+// backendStats accumulates per-host request statistics
+type backendStats struct {
+	requests atomic.Uint64
+	errors   atomic.Uint64 // responses with 5xx status
+	latency  histogram
+
+	truncated atomic.Uint64 // responses with body cut short by backend
+
+	// requests checked against latency objective and ones that missed it;
+	// objective may change on reload, so these can mix different targets
+	sloRequests   atomic.Uint64
+	sloViolations atomic.Uint64
+
+	// latency of requests admitted at given concurrency level, with
+	// number of such requests being total count of each histogram
+	byConcurrency [concurrencyBands]histogram
+}
+
+// record accounts request completed in d. If objective is positive, d is
+// also checked against it.
+func (s *backendStats) record(status int, d, objective time.Duration) {
+	s.requests.Add(1)
+	if status >= 500 {
+		s.errors.Add(1)
+	}
+	s.latency.observe(d)
+	if objective > 0 {
+		s.sloRequests.Add(1)
+		if d > objective {
+			s.sloViolations.Add(1)
+		}
+	}
+}
+
+// sloRatio returns fraction of requests that met latency objective, or nil
+// if none were checked against it
+func (s *backendStats) sloRatio() *float64 {
+	total := s.sloRequests.Load()
+	if total == 0 {
+		return nil
+	}
+	ratio := 1 - float64(s.sloViolations.Load())/float64(total)
+	return &ratio
+}
+
+// recordConcurrency accounts request admitted when n requests were in flight
+// (including itself) and completed in d
+func (s *backendStats) recordConcurrency(n int, d time.Duration) {
+	s.byConcurrency[concurrencyBand(n)].observe(d)
+}
+
+// statusWriter records status code of response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 && code >= 200 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap allows http.ResponseController to reach underlying writer
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// StreamingConfig describes how to recognize long-lived requests (downloads,
+// event streams, websockets) and how many of them can be served concurrently.
+// Such requests are served from a separate bucket of MaxConns size.
+//
+// Upgrade requests and requests matching one of Paths are put into streaming
+// bucket right away. Requests having response with one of ContentTypes are
+// moved there once response headers are received, if streaming bucket has
+// free slots.
+type StreamingConfig struct {
+	MaxConns int
+	// ContentTypes are media types like "text/event-stream"; "type/*"
+	// form matches any subtype
+	ContentTypes []string `json:",omitempty"`
+	// Paths are path.Match patterns matched against request path
+	Paths []string `json:",omitempty"`
+}
+
+func (c *StreamingConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.MaxConns < 1 {
+		return errors.New("Streaming.MaxConns is too low")
+	}
+	for _, p := range c.Paths {
+		if _, err := path.Match(p, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *StreamingConfig) matchRequest(r *http.Request) bool {
+	if isUpgrade(r) {
+		return true
+	}
+	for _, p := range c.Paths {
+		if ok, _ := path.Match(p, r.URL.Path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *StreamingConfig) matchContentType(ct string) bool {
+	return matchMediaType(ct, c.ContentTypes)
+}
+
+// matchMediaType reports whether media type of Content-Type value ct is one
+// of patterns, which are either media types or "type/*" matching any subtype
+func matchMediaType(ct string, patterns []string) bool {
+	if ct == "" {
+		return false
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	for _, s := range patterns {
+		s = strings.ToLower(s)
+		if mt == s || strings.HasSuffix(s, "/*") && strings.HasPrefix(mt, s[:len(s)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// slotKey is a context key for *slot held by request
+type slotKey struct{}
+
+// slot is a place taken by request in one of backend buckets
+type slot struct {
+	bucket *bucket
+}
+
+func (s *slot) release() { s.bucket.release() }
+
+// moveTo takes place in another bucket and releases the current one. If other
+// bucket is full, slot is kept in the current one.
+func (s *slot) moveTo(b *bucket) {
+	if s.bucket == b {
+		return
+	}
+	if b.tryAcquire() {
+		s.bucket.release()
+		s.bucket = b
+	}
+}
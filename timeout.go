@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// TimeoutHeaderConfig configures header passing remaining time budget of
+// request to backend, so it can abandon work that won't complete in time.
+// It is only sent if route has Timeout set.
+type TimeoutHeaderConfig struct {
+	// Name of the header, i.e. "X-Request-Timeout" or "grpc-timeout"
+	Name string
+	// Format is one of "ms" (integer milliseconds, default), "s"
+	// (fractional seconds) or "grpc" (grpc-timeout header format)
+	Format string `json:",omitempty"`
+}
+
+func (c *TimeoutHeaderConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.Name == "" {
+		return errors.New("TimeoutHeader.Name is empty")
+	}
+	switch c.Format {
+	case "", "ms", "s", "grpc":
+		return nil
+	}
+	return errors.New("TimeoutHeader.Format should be one of: ms, s, grpc")
+}
+
+// setHeader sets header with time left until backend should respond. It is
+// expected to be called from Director.
+func (c *TimeoutHeaderConfig) setHeader(r *http.Request) {
+	t, ok := r.Context().Value(responseTimeoutKey{}).(*responseTimeout)
+	if !ok {
+		return
+	}
+	left := time.Until(t.deadline)
+	if left < 0 {
+		left = 0
+	}
+	var v string
+	switch c.Format {
+	case "s":
+		v = strconv.FormatFloat(left.Seconds(), 'f', 3, 64)
+	case "grpc":
+		v = grpcTimeout(left)
+	default:
+		v = strconv.FormatInt(left.Milliseconds(), 10)
+	}
+	r.Header.Set(c.Name, v)
+}
+
+// grpcTimeout formats d as grpc-timeout header value: at most 8 digits
+// followed by unit, using the finest unit that fits.
+func grpcTimeout(d time.Duration) string {
+	const max = 1e8 - 1
+	for _, u := range [...]struct {
+		d    time.Duration
+		unit string
+	}{
+		{time.Nanosecond, "n"},
+		{time.Microsecond, "u"},
+		{time.Millisecond, "m"},
+		{time.Second, "S"},
+		{time.Minute, "M"},
+	} {
+		if d/u.d <= max {
+			return strconv.FormatInt(int64(d/u.d), 10) + u.unit
+		}
+	}
+	return strconv.FormatInt(int64(d/time.Hour), 10) + "H"
+}
+
+// responseTimeout limits time backend may take to respond with headers: once
+// deadline passes, request context is canceled with context.DeadlineExceeded
+// cause, unless timer is stopped first. Deadline is deliberately not set on
+// the context itself, as it would also cut response body, i.e. an event
+// stream that stays open for long.
+type responseTimeout struct {
+	deadline time.Time
+	timer    *time.Timer
+}
+
+type responseTimeoutKey struct{}
+
+// withResponseTimeout returns shallow copy of r with context canceled if
+// backend doesn't respond by deadline, and function releasing its resources
+func withResponseTimeout(r *http.Request, deadline time.Time) (*http.Request, func()) {
+	ctx, cancel := context.WithCancelCause(r.Context())
+	t := &responseTimeout{deadline: deadline}
+	t.timer = time.AfterFunc(time.Until(deadline), func() { cancel(context.DeadlineExceeded) })
+	r = r.WithContext(context.WithValue(ctx, responseTimeoutKey{}, t))
+	return r, func() { t.timer.Stop(); cancel(nil) }
+}
+
+// stopResponseTimeout is a ModifyResponse hook stopping timer set by
+// withResponseTimeout once response headers are received
+func stopResponseTimeout(r *http.Response) error {
+	if t, ok := r.Request.Context().Value(responseTimeoutKey{}).(*responseTimeout); ok {
+		t.timer.Stop()
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			select {
+			case <-time.After(5 * timeout):
+			case <-r.Context().Done():
+				return
+			}
+			w.Write([]byte("late"))
+		case "/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.(http.Flusher).Flush()
+			for i := 0; i < 5; i++ {
+				time.Sleep(timeout / 2)
+				fmt.Fprintf(w, "data: %d\n\n", i)
+				w.(http.Flusher).Flush()
+			}
+		case "/budget":
+			w.Write([]byte(r.Header.Get("X-Request-Timeout")))
+		}
+	}))
+	defer backend.Close()
+	rp := newTestProxy(t, map[string]Route{"a": {
+		Backend:       backend.URL,
+		Timeout:       Duration(timeout),
+		TimeoutHeader: &TimeoutHeaderConfig{Name: "X-Request-Timeout"},
+	}})
+
+	if w := serve(rp, httptest.NewRequest("GET", "http://a/slow", nil)); w.Code != http.StatusGatewayTimeout {
+		t.Errorf("slow backend: got status %d, want %d", w.Code, http.StatusGatewayTimeout)
+	}
+
+	// stream lasting longer than timeout is not cut once headers arrived
+	w := serve(rp, httptest.NewRequest("GET", "http://a/events", nil))
+	if want := "data: 0\n\ndata: 1\n\ndata: 2\n\ndata: 3\n\ndata: 4\n\n"; w.Code != 200 || w.Body.String() != want {
+		t.Errorf("event stream: got %d %q, want 200 %q", w.Code, w.Body.String(), want)
+	}
+
+	w = serve(rp, httptest.NewRequest("GET", "http://a/budget", nil))
+	if ms, err := strconv.Atoi(w.Body.String()); err != nil || ms <= 0 || ms > int(timeout/time.Millisecond) {
+		t.Errorf("backend got timeout header %q, want up to %d", w.Body.String(), timeout/time.Millisecond)
+	}
+}
+
+func TestGRPCTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "0n"},
+		{1500 * time.Millisecond, "1500000u"},
+		{99999999 * time.Nanosecond, "99999999n"},
+		{2 * time.Hour, "7200000m"},
+	} {
+		if got := grpcTimeout(tc.d); got != tc.want {
+			t.Errorf("grpcTimeout(%v) = %q, want %q", tc.d, got, tc.want)
+		}
+	}
+}
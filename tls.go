@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyPair holds paths to PEM-encoded certificate and its private key
+type KeyPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// certStore holds certificates loaded from disk and picks one matching
+// client hello. Certificates can be re-read from disk with reload, so that
+// renewed certificates are picked up by new handshakes without restart.
+type certStore struct {
+	pairs []KeyPair
+
+	mu    sync.RWMutex
+	certs []tls.Certificate
+}
+
+func newCertStore(pairs []KeyPair) (*certStore, error) {
+	if len(pairs) == 0 {
+		return nil, errors.New("no certificates provided")
+	}
+	s := &certStore{pairs: pairs}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reload reads all certificates from disk and replaces currently used set
+// only if every one of them was loaded successfully.
+func (s *certStore) reload() error {
+	certs := make([]tls.Certificate, 0, len(s.pairs))
+	for _, p := range s.pairs {
+		cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.certs = certs
+	return nil
+}
+
+// GetCertificate is suitable to be used as tls.Config.GetCertificate. It
+// returns first certificate supporting given client hello, or the first
+// configured certificate if none match. Picked certificate is recorded in
+// connInfo of handshake context, if there is one.
+func (s *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := s.pick(hello)
+	if c, ok := hello.Context().Value(connInfoKey{}).(*connInfo); ok {
+		c.cert.Store(cert)
+	}
+	return cert, nil
+}
+
+func (s *certStore) pick(hello *tls.ClientHelloInfo) *tls.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i := range s.certs {
+		if hello.SupportsCertificate(&s.certs[i]) == nil {
+			return &s.certs[i]
+		}
+	}
+	return &s.certs[0]
+}
+
+// misdirected reports whether host of request received over TLS is not
+// covered by certificate presented on its connection, which happens when
+// HTTP/2 client reuses connection for another host. Certificate is unknown
+// on resumed sessions, these are never reported.
+func misdirected(r *http.Request) bool {
+	if r.TLS == nil {
+		return false
+	}
+	c, ok := r.Context().Value(connInfoKey{}).(*connInfo)
+	if !ok {
+		return false
+	}
+	cert := c.cert.Load()
+	if cert == nil || cert.Leaf == nil {
+		return false
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return cert.Leaf.VerifyHostname(host) != nil
+}
+
+// sessionTicketKeysKept is a number of session ticket keys in use: the
+// current one, used to encrypt new tickets, and previous ones still accepted
+// for resumption
+const sessionTicketKeysKept = 3
+
+// rotateSessionTicketKeys sets new random session ticket key on cfg and
+// starts background goroutine replacing it every interval, keeping a couple
+// of previous keys valid for resumption.
+func rotateSessionTicketKeys(cfg *tls.Config, interval time.Duration) error {
+	var keys [][32]byte
+	rotate := func() error {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		keys = append([][32]byte{key}, keys...)
+		if len(keys) > sessionTicketKeysKept {
+			keys = keys[:sessionTicketKeysKept]
+		}
+		cfg.SetSessionTicketKeys(keys)
+		return nil
+	}
+	if err := rotate(); err != nil {
+		return err
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := rotate(); err != nil {
+				log.Println("session ticket keys rotation:", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// alpnLogger returns function suitable as tls.Config.GetConfigForClient,
+// which doesn't alter config, but logs clients whose offered ALPN protocols
+// have nothing in common with supported ones, as such handshakes fail.
+func alpnLogger(supported []string) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if len(hello.SupportedProtos) == 0 {
+			return nil, nil
+		}
+		for _, p := range hello.SupportedProtos {
+			if slices.Contains(supported, p) {
+				return nil, nil
+			}
+		}
+		log.Printf("TLS client %s offered ALPN protocols %q, supported are %q",
+			hello.Conn.RemoteAddr(), hello.SupportedProtos, supported)
+		return nil, nil
+	}
+}
+
+// handshakeErrors is an io.Writer to be used as http.Server.ErrorLog
+// destination. It passes everything to stderr, counting TLS handshake errors
+// logged by server by their cause.
+type handshakeErrors struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func (h *handshakeErrors) Write(b []byte) (int, error) {
+	const marker = "TLS handshake error from "
+	if i := bytes.Index(b, []byte(marker)); i >= 0 {
+		cause := handshakeErrorCause(string(b[i+len(marker):]))
+		h.mu.Lock()
+		if h.counts == nil {
+			h.counts = make(map[string]uint64)
+		}
+		h.counts[cause]++
+		h.mu.Unlock()
+	}
+	return os.Stderr.Write(b)
+}
+
+// snapshot returns copy of current counters
+func (h *handshakeErrors) snapshot() map[string]uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.counts) == 0 {
+		return nil
+	}
+	out := make(map[string]uint64, len(h.counts))
+	for k, v := range h.counts {
+		out[k] = v
+	}
+	return out
+}
+
+// handshakeErrorCause maps text of handshake error to short cause name
+func handshakeErrorCause(msg string) string {
+	for _, c := range [...]struct{ substr, cause string }{
+		{"application protocol", "alpn"},
+		{"protocol version", "version"},
+		{"unsupported versions", "version"},
+		{"cipher suite", "cipher"},
+		{"certificate", "certificate"},
+		{"not look like a TLS handshake", "not_tls"},
+		{"HTTP request to an HTTPS server", "not_tls"},
+		{"timeout", "timeout"},
+		{"EOF", "eof"},
+		{"connection reset", "eof"},
+	} {
+		if strings.Contains(msg, c.substr) {
+			return c.cause
+		}
+	}
+	return "other"
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeKeyPair writes self-signed certificate for hosts (names or IP
+// addresses) and its key to dir under given name
+func writeKeyPair(t *testing.T, dir, name string, hosts ...string) KeyPair {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tpl.IPAddresses = append(tpl.IPAddresses, ip)
+		} else {
+			tpl.DNSNames = append(tpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := KeyPair{
+		CertFile: filepath.Join(dir, name+".crt"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+	}
+	if err := os.WriteFile(p.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// handshakeNames returns DNS names of certificate server at addr presents
+// for serverName
+func handshakeNames(t *testing.T, addr, serverName string) []string {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].DNSNames
+}
+
+func TestCertStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	pair := writeKeyPair(t, dir, "site", "old.example")
+	store, err := newCertStore([]KeyPair{pair})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetCertificate: store.GetCertificate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c.(*tls.Conn).Handshake()
+				c.Close()
+			}()
+		}
+	}()
+	addr := ln.Addr().String()
+	if got := handshakeNames(t, addr, "old.example"); len(got) != 1 || got[0] != "old.example" {
+		t.Fatalf("before reload got certificate for %q", got)
+	}
+
+	// replace files in place, as certificate renewal does
+	writeKeyPair(t, dir, "site", "new.example")
+	if err := store.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := handshakeNames(t, addr, "new.example"); len(got) != 1 || got[0] != "new.example" {
+		t.Fatalf("after reload got certificate for %q", got)
+	}
+
+	// broken files keep previous certificates in use
+	if err := os.WriteFile(pair.KeyFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.reload(); err == nil {
+		t.Fatal("reload of broken key succeeded")
+	}
+	if got := handshakeNames(t, addr, "new.example"); len(got) != 1 || got[0] != "new.example" {
+		t.Fatalf("after failed reload got certificate for %q", got)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+)
+
+// truncationBody wraps backend response body to report it ending with error,
+// i.e. when backend closes connection in the middle of chunked response.
+// Client is notified by httputil.ReverseProxy itself: it aborts the handler,
+// which closes HTTP/1 connection without final chunk or resets HTTP/2
+// stream, so truncated response can't be mistaken for complete one.
+type truncationBody struct {
+	io.ReadCloser
+	backend, host string
+	stats         *backendStats
+	n             int64 // bytes read so far
+	failed        bool
+}
+
+func (b *truncationBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	// canceled context means client went away or request timed out, not
+	// that backend failed
+	if err != nil && err != io.EOF && !b.failed &&
+		!errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		b.failed = true
+		b.stats.truncated.Add(1)
+		log.Printf("backend %s for %s: response body truncated after %d bytes: %v", b.backend, b.host, b.n, err)
+	}
+	return n, err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/iotest"
+)
+
+func TestTruncatedResponse(t *testing.T) {
+	// backend sending part of chunked response and closing connection
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n")
+		brw.Flush()
+	}))
+	defer backend.Close()
+	rp := newTestProxy(t, map[string]Route{"a": {Backend: backend.URL}})
+	srv := httptest.NewServer(rp)
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "a"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err == nil {
+		t.Fatalf("client got complete response %q", b)
+	}
+	if string(b) != "hello" {
+		t.Errorf("client got %q before error", b)
+	}
+	if n := rp.table.Load().backends["a"].stats.truncated.Load(); n != 1 {
+		t.Errorf("%d truncated responses counted, want 1", n)
+	}
+}
+
+func TestTruncatedResponseCounting(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want uint64
+	}{
+		{io.EOF, 0},
+		{io.ErrUnexpectedEOF, 1},
+		{context.Canceled, 0},
+		{context.DeadlineExceeded, 0},
+		{fmt.Errorf("read: %w", context.DeadlineExceeded), 0},
+	} {
+		stats := new(backendStats)
+		b := &truncationBody{ReadCloser: io.NopCloser(iotest.ErrReader(tc.err)), stats: stats}
+		b.Read(make([]byte, 1))
+		b.Read(make([]byte, 1)) // the same failure is counted once
+		if n := stats.truncated.Load(); n != tc.want {
+			t.Errorf("%v: %d truncated responses counted, want %d", tc.err, n, tc.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"syscall"
+)
+
+// SocketBuffers sets SO_RCVBUF and SO_SNDBUF options of listening sockets,
+// which are inherited by accepted connections. They apply to both HTTP/1.1
+// and HTTP/2 connections; zero keeps system default. Kernel may adjust
+// requested values, i.e. Linux doubles them and caps them by net.core.rmem_max
+// and net.core.wmem_max.
+type SocketBuffers struct {
+	Read  int `json:",omitempty"`
+	Write int `json:",omitempty"`
+}
+
+func (b *SocketBuffers) validate() error {
+	if b != nil && (b.Read < 0 || b.Write < 0) {
+		return errors.New("SocketBuffers sizes should not be negative")
+	}
+	return nil
+}
+
+// control is suitable as net.ListenConfig.Control
+func (b *SocketBuffers) control(network, address string, c syscall.RawConn) error {
+	if b == nil || b.Read == 0 && b.Write == 0 {
+		return nil
+	}
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = setSocketBuffers(fd, b.Read, b.Write)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// HTTP2Config tunes HTTP/2 server; it has no effect on HTTP/1.1 connections.
+// Zero values keep net/http defaults.
+type HTTP2Config struct {
+	MaxConcurrentStreams          int `json:",omitempty"`
+	MaxReadFrameSize              int `json:",omitempty"`
+	MaxReceiveBufferPerConnection int `json:",omitempty"`
+	MaxReceiveBufferPerStream     int `json:",omitempty"`
+}
+
+func (c *HTTP2Config) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.MaxConcurrentStreams < 0 || c.MaxReceiveBufferPerConnection < 0 ||
+		c.MaxReceiveBufferPerStream < 0 {
+		return errors.New("HTTP2 settings should not be negative")
+	}
+	if c.MaxReadFrameSize != 0 && (c.MaxReadFrameSize < 1<<14 || c.MaxReadFrameSize > 1<<24-1) {
+		return errors.New("HTTP2.MaxReadFrameSize should be between 16KiB and 16MiB")
+	}
+	return nil
+}
+
+func (c *HTTP2Config) config() *http.HTTP2Config {
+	if c == nil {
+		return nil
+	}
+	return &http.HTTP2Config{
+		MaxConcurrentStreams:          c.MaxConcurrentStreams,
+		MaxReadFrameSize:              c.MaxReadFrameSize,
+		MaxReceiveBufferPerConnection: c.MaxReceiveBufferPerConnection,
+		MaxReceiveBufferPerStream:     c.MaxReceiveBufferPerStream,
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+func setSocketBuffers(fd uintptr, read, write int) error {
+	return errors.New("SocketBuffers are not supported on this platform")
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+func setSocketBuffers(fd uintptr, read, write int) error {
+	if read > 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, read); err != nil {
+			return err
+		}
+	}
+	if write > 0 {
+		return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, write)
+	}
+	return nil
+}
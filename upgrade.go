@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// isUpgrade reports whether r asks for protocol upgrade
+func isUpgrade(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" &&
+		httpguts.HeaderValuesContainsToken(r.Header["Connection"], "Upgrade")
+}
+
+// upgradeAllowed reports whether every protocol in Upgrade header of r is
+// on the allowed list. Protocols are compared by name, case-insensitively,
+// ignoring version: "websocket" allows "WebSocket/13".
+func upgradeAllowed(r *http.Request, allowed []string) bool {
+	for _, v := range r.Header["Upgrade"] {
+		for _, proto := range strings.Split(v, ",") {
+			name, _, _ := strings.Cut(strings.TrimSpace(proto), "/")
+			if name == "" {
+				continue
+			}
+			ok := false
+			for _, a := range allowed {
+				if strings.EqualFold(name, a) {
+					ok = true
+					break
+				}
+			}
+			if !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAllowedUpgrades(t *testing.T) {
+	// backend switching to any requested protocol and echoing data back
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isUpgrade(r) {
+			io.WriteString(w, "plain")
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " +
+			r.Header.Get("Upgrade") + "\r\n\r\n")
+		brw.Flush()
+		line, _ := brw.ReadString('\n')
+		io.WriteString(conn, line)
+	}))
+	defer backend.Close()
+	rp := newTestProxy(t, map[string]Route{"a": {
+		Backend:         backend.URL,
+		AllowedUpgrades: []string{"websocket"},
+	}})
+	srv := httptest.NewServer(rp)
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		upgrade string
+		status  int
+	}{
+		{"", 200},
+		{"websocket", 101},
+		{"WebSocket/13", 101},
+		{"h2c", 400},
+		{"websocket, h2c", 400},
+	} {
+		req, err := http.NewRequest("GET", srv.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "a"
+		if tc.upgrade != "" {
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", tc.upgrade)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tc.status {
+			t.Errorf("Upgrade %q: got status %d, want %d", tc.upgrade, resp.StatusCode, tc.status)
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			rw := resp.Body.(io.ReadWriter)
+			io.WriteString(rw, "ping\n")
+			if line, err := bufio.NewReader(rw).ReadString('\n'); line != "ping\n" {
+				t.Errorf("Upgrade %q: echo over upgraded connection got %q, %v", tc.upgrade, line, err)
+			}
+		}
+		resp.Body.Close()
+	}
+}